@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
+	"go.uber.org/zap"
+)
+
+const (
+	// pingTimeout bounds the requests checking that the server is up
+	pingTimeout = 2 * time.Second
+	// pollInterval is how often the server is checked while waiting for it
+	pollInterval = 100 * time.Millisecond
+)
+
+var (
+	pidFile     string
+	lockFile    string
+	logFile     string
+	startWait   time.Duration
+	stopTimeout time.Duration
+)
+
+// serverStatus is what `server status` reports
+type serverStatus struct {
+	Pid     int                      `json:"pid,omitempty" yaml:"pid,omitempty"`
+	Running bool                     `json:"running" yaml:"running"`
+	Ping    string                   `json:"ping" yaml:"ping"`
+	Version *types.ServerVersionInfo `json:"version,omitempty" yaml:"version,omitempty"`
+}
+
+var serverStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Starts the server in the background",
+	Long: `Starts the server in the background and waits for it to answer, its output goes to the log file.
+Nothing is done when the server is already running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if pid, running := runningServer(); running {
+			fmt.Printf("server already running (pid %d)\n", pid)
+			return
+		}
+		startServer()
+	},
+}
+
+var serverStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops the server",
+	Long: `Asks the server to stop and waits for it to complete the in-flight requests and stop the plugins.
+Nothing is done when the server is not running.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stopServer()
+	},
+}
+
+var serverRestartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restarts the server, or starts it if it is not running",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		stopServer()
+		startServer()
+	},
+}
+
+var serverUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Replaces the server with a new one running the current binary, without downtime",
+	Long: `Asks the server to start a new one with the gowerline binary as it is on disk now, and to hand it
+its listeners. The running server only exits once the new one is ready, and keeps serving if it does not.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		pid, running := runningServer()
+		if !running {
+			log.Fatal("server is not running")
+		}
+
+		if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+			log.Fatal("could not upgrade the server", zap.Int("pid", pid), zap.Error(err))
+		}
+
+		deadline := time.Now().Add(stopTimeout)
+		for utils.ProcessAlive(pid) {
+			if time.Now().After(deadline) {
+				log.Fatal("the server was not replaced in time, it is still serving", zap.Int("pid", pid), zap.Duration("timeout", stopTimeout))
+			}
+			time.Sleep(pollInterval)
+		}
+
+		newPid, running := runningServer()
+		if !running {
+			log.Fatal("the server exited without being replaced")
+		}
+		fmt.Printf("server upgraded (pid %d -> %d)\n", pid, newPid)
+	},
+}
+
+var serverStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Tells whether the server is running and answering",
+	Long:  `Exits with a non zero status when the server does not answer.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var status serverStatus
+		status.Pid, status.Running = runningServer()
+		if !status.Running {
+			status.Pid = 0
+		}
+
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
+		if err != nil {
+			log.Fatal("could not load config", zap.Error(err))
+		}
+
+		status.Version, err = pingServer(cfg)
+		if err != nil {
+			status.Ping = err.Error()
+		} else {
+			status.Ping = "ok"
+		}
+
+		output(status)
+		if err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+// runningServer returns the pid of the server and whether it is running. The pid
+// file is only trusted while the server holds the lock, since the pid of a server
+// that did not remove it may have been reused by an unrelated process. Such a
+// stale pid file is removed.
+func runningServer() (int, bool) {
+	file := paths.Expand(pidFile)
+	pid, err := utils.ReadPidFile(file)
+	if err != nil {
+		return 0, false
+	}
+
+	locked, err := utils.Locked(paths.Expand(lockFile))
+	if err != nil {
+		log.Warn("could not check the lock file", zap.String("lockfile", lockFile), zap.Error(err))
+	}
+	if locked && utils.ProcessAlive(pid) {
+		return pid, true
+	}
+
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("could not remove the stale pid file", zap.String("pidfile", pidFile), zap.Error(err))
+	}
+	return 0, false
+}
+
+// startServer runs the server in the background, in its own session so that
+// it outlives the shell, and waits for it to answer
+func startServer() {
+	cfg, err := config.NewUnresolvedConfigFromFile(configFile)
+	if err != nil {
+		log.Fatal("could not load config", zap.Error(err))
+	}
+	// a server that did not write the pid file, such as an older one
+	if _, err := pingServer(cfg); err == nil {
+		fmt.Println("server already running")
+		return
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal("could not find the gowerline binary", zap.Error(err))
+	}
+
+	logPath := paths.Expand(logFile)
+	if err := os.MkdirAll(path.Dir(logPath), 0700); err != nil {
+		log.Fatal("could not create the log directory", zap.Error(err))
+	}
+	logOutput, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Fatal("could not open the log file", zap.Error(err))
+	}
+	defer logOutput.Close()
+
+	server := exec.Command(
+		executable, "server", "run",
+		"--config", configFile,
+		"--plugins", pluginsDir,
+		"--pidfile", paths.Expand(pidFile),
+		"--lockfile", paths.Expand(lockFile),
+	)
+	server.Stdout = logOutput
+	server.Stderr = logOutput
+	server.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := server.Start(); err != nil {
+		log.Fatal("could not start the server", zap.Error(err))
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- server.Wait()
+	}()
+
+	deadline := time.After(startWait)
+	for {
+		if _, err := pingServer(cfg); err == nil {
+			fmt.Printf("server started (pid %d)\n", server.Process.Pid)
+			return
+		}
+
+		select {
+		case err := <-exited:
+			log.Fatal("the server exited", zap.Error(err), zap.String("log_file", logPath))
+		case <-deadline:
+			log.Fatal("the server did not answer in time", zap.Duration("timeout", startWait), zap.String("log_file", logPath))
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// stopServer stops the server and waits for it to exit
+func stopServer() {
+	pid, running := runningServer()
+	if !running {
+		fmt.Println("server is not running")
+		return
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		log.Fatal("could not stop the server", zap.Int("pid", pid), zap.Error(err))
+	}
+
+	deadline := time.Now().Add(stopTimeout)
+	for utils.ProcessAlive(pid) {
+		if time.Now().After(deadline) {
+			log.Fatal("the server did not stop in time", zap.Int("pid", pid), zap.Duration("timeout", stopTimeout))
+		}
+		time.Sleep(pollInterval)
+	}
+
+	fmt.Printf("server stopped (pid %d)\n", pid)
+}
+
+// pingServer checks that the server answers and returns its version
+func pingServer(cfg *config.Config) (*types.ServerVersionInfo, error) {
+	if cfg.Listen.Unix == "" && cfg.Listen.Token {
+		// the token is generated by the server when it starts
+		if _, err := os.Stat(cfg.Listen.TokenPath()); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := utils.NewHTTPClientFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = pingTimeout
+
+	resp, err := client.Get(utils.BaseURLFromConfig(cfg) + "/ping")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	resp, err = client.Get(utils.BaseURLFromConfig(cfg) + "/version")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var serverInfo types.ServerVersionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&serverInfo); err != nil {
+		return nil, fmt.Errorf("could not decode the version of the server: %w", err)
+	}
+
+	return &serverInfo, nil
+}
@@ -2,7 +2,10 @@ package cmd
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
@@ -11,11 +14,14 @@ import (
 	"github.com/thomas-maurice/gowerline/gowerline-server/config"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
 	"github.com/thomas-maurice/gowerline/gowerline-server/utils"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
 var (
-	runArgs []string
+	runArgs      []string
+	runBatch     bool
+	adminPersist bool
 )
 
 var pluginCmd = &cobra.Command{
@@ -29,12 +35,15 @@ var pluginListCmd = &cobra.Command{
 	Short: "Lists plugins currently loaded",
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg, err := config.NewConfigFromFile(configFile)
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
 		if err != nil {
 			log.Panic("could not load config", zap.Error(err))
 		}
 
-		client := utils.NewHTTPClientFromConfig(cfg)
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
 
 		resp, err := client.Get(utils.BaseURLFromConfig(cfg) + "/plugins")
 		if err != nil {
@@ -46,17 +55,17 @@ var pluginListCmd = &cobra.Command{
 		}
 		defer resp.Body.Close()
 
-		pluginInfo := make(map[string]types.PluginMetadata)
+		pluginInfo := make(map[string]types.PluginStatus)
 		err = json.Unmarshal(b, &pluginInfo)
 		if err != nil {
 			log.Fatal("could not unmarshal server response", zap.Error(err))
 		}
 
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Description", "Author", "Version"})
+		table.SetHeader([]string{"Name", "Status", "Description", "Author", "Version", "Last error"})
 
-		for name, meta := range pluginInfo {
-			table.Append([]string{name, meta.Description, meta.Author, meta.Version})
+		for name, status := range pluginInfo {
+			table.Append([]string{name, status.State, status.Description, status.Author, status.Version, status.LastError})
 		}
 		table.Render()
 	},
@@ -68,12 +77,15 @@ var pluginFunctionsCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Long:  ``,
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg, err := config.NewConfigFromFile(configFile)
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
 		if err != nil {
 			log.Panic("could not load config", zap.Error(err))
 		}
 
-		client := utils.NewHTTPClientFromConfig(cfg)
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
 
 		resp, err := client.Get(utils.BaseURLFromConfig(cfg) + "/plugins")
 		if err != nil {
@@ -94,11 +106,11 @@ var pluginFunctionsCmd = &cobra.Command{
 		for name, meta := range pluginInfo {
 			if name == args[0] {
 				table := tablewriter.NewWriter(os.Stdout)
-				table.SetHeader([]string{"Function name", "Description", "Argument", "Argument help"})
+				table.SetHeader([]string{"Function name", "Description", "Argument", "Type", "Required", "Default", "Argument help"})
 				for _, functionMeta := range meta.Functions {
-					table.Append([]string{functionMeta.Name, functionMeta.Description, "", ""})
-					for paramName, paramDesc := range functionMeta.Parameters {
-						table.Append([]string{"", "", paramName, paramDesc})
+					table.Append([]string{functionMeta.Name, functionMeta.Description, "", "", "", "", ""})
+					for _, param := range functionMeta.Parameters {
+						table.Append([]string{"", "", param.Name, param.TypeName(), formatRequired(param.Required), formatDefault(param.Default), parameterHelp(param)})
 					}
 				}
 				table.Render()
@@ -111,96 +123,350 @@ var pluginFunctionsCmd = &cobra.Command{
 }
 
 var pluginRunFunction = &cobra.Command{
-	Use:   "run-function [function]",
-	Short: "Runs a function with the given parameters",
-	Args:  cobra.ExactArgs(1),
-	Long:  ``,
+	Use:   "run-function [function...]",
+	Short: "Runs one or more functions with the given parameters",
+	Long:  `When several functions are given, they are rendered in a single batch request`,
+	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		cfg, err := config.NewConfigFromFile(configFile)
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
 		if err != nil {
 			log.Panic("could not load config", zap.Error(err))
 		}
 
-		client := utils.NewHTTPClientFromConfig(cfg)
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
 
-		argsMap := make(map[string]string)
-		for _, arg := range runArgs {
-			splitted := strings.Split(arg, "=")
-			if len(splitted) == 0 {
-				continue
-			} else if len(splitted) == 1 {
-				argsMap[splitted[0]] = ""
-			} else if len(splitted) == 2 {
-				argsMap[splitted[0]] = splitted[1]
-			} else {
-				argsMap[splitted[0]] = strings.Join(splitted[1:], "=")
-			}
+		argsMaps, err := functionArgs(args, runArgs)
+		if err != nil {
+			log.Fatal("invalid arguments", zap.Error(err))
 		}
 
-		var payload types.Payload
-		payload.Function = args[0]
+		functions := functionDescriptors(client, cfg)
 
-		b, err := json.Marshal(argsMap)
-		if err != nil {
-			log.Fatal("could not marshal args", zap.Error(err))
+		// the arguments are converted to the types the functions expect them as
+		payloadArgs := make(map[string]*json.RawMessage, len(args))
+		for _, function := range args {
+			typedArgs, err := coerceArgs(functions[function], argsMaps[function])
+			if err != nil {
+				log.Fatal("invalid arguments", zap.String("function", function), zap.Error(err))
+			}
+
+			b, err := json.Marshal(typedArgs)
+			if err != nil {
+				log.Fatal("could not marshal args", zap.Error(err))
+			}
+			msg := json.RawMessage(b)
+			payloadArgs[function] = &msg
 		}
 
-		msg := json.RawMessage(b)
-		payload.Args = &msg
 		cwd, err := os.Getwd()
 		if err != nil {
 			log.Fatal("could not gte current working directory", zap.Error(err))
 		}
 
-		payload.Cwd = cwd
-		env := os.Environ()
-		payload.Env = make(map[string]string)
-		for _, envVar := range env {
+		env := make(map[string]string)
+		for _, envVar := range os.Environ() {
 			splitted := strings.Split(envVar, "=")
 			if len(splitted) == 0 {
 				continue
 			} else if len(splitted) == 1 {
-				payload.Env[splitted[0]] = ""
+				env[splitted[0]] = ""
 			} else if len(splitted) == 2 {
-				payload.Env[splitted[0]] = splitted[1]
+				env[splitted[0]] = splitted[1]
 			} else {
-				payload.Env[splitted[0]] = strings.Join(splitted[1:], "=")
+				env[splitted[0]] = strings.Join(splitted[1:], "=")
 			}
 		}
 
-		b, err = json.Marshal(payload)
-		if err != nil {
-			log.Fatal("could not marshal request", zap.Error(err))
+		if len(args) > 1 || runBatch {
+			var request types.BatchRequest
+			request.Cwd = cwd
+			request.Env = env
+			for _, function := range args {
+				request.Payloads = append(request.Payloads, types.Payload{
+					Function: function,
+					Args:     payloadArgs[function],
+				})
+			}
+
+			if debug {
+				output(request)
+			}
+
+			results := make([]types.BatchResult, 0)
+			postJSON(client, utils.BaseURLFromConfig(cfg)+"/plugins/batch", request, &results)
+			output(results)
+			return
 		}
 
+		var payload types.Payload
+		payload.Function = args[0]
+		payload.Args = payloadArgs[args[0]]
+		payload.Cwd = cwd
+		payload.Env = env
+
 		if debug {
 			output(payload)
 		}
 
-		resp, err := client.Post(utils.BaseURLFromConfig(cfg)+"/plugin", "application/json", strings.NewReader(string(b)))
-		if err != nil {
-			log.Fatal("could not fetch the server's version", zap.Error(err))
+		content := make([]types.PowerlineReturn, 0)
+		postJSON(client, utils.BaseURLFromConfig(cfg)+"/plugin", payload, &content)
+		output(content)
+	},
+}
+
+var pluginEnableCmd = &cobra.Command{
+	Use:   "enable [plugin]",
+	Short: "Starts a plugin disabled at runtime again",
+	Long:  `Waits for the plugin to start, unless it is lazy. Plugins disabled in the configuration cannot be enabled this way.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pluginAdmin("enable", args[0], adminPersist)
+	},
+}
+
+var pluginDisableCmd = &cobra.Command{
+	Use:   "disable [plugin]",
+	Short: "Stops a plugin until it is enabled again",
+	Long: `The functions of the plugin are unknown to the server until it is enabled again, the other plugins are
+left untouched. It is enabled again when the server restarts, unless --persist is given.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pluginAdmin("disable", args[0], adminPersist)
+	},
+}
+
+var pluginRestartCmd = &cobra.Command{
+	Use:   "restart [plugin]",
+	Short: "Stops a plugin and starts it again from scratch",
+	Long:  `Waits for the plugin to start, unless it is lazy. The other plugins are left untouched.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		pluginAdmin("restart", args[0], false)
+	},
+}
+
+// pluginAdmin asks the server to enable, disable or restart a plugin
+func pluginAdmin(action string, name string, persist bool) {
+	cfg, err := config.NewUnresolvedConfigFromFile(configFile)
+	if err != nil {
+		log.Panic("could not load config", zap.Error(err))
+	}
+
+	client, err := utils.NewHTTPClientFromConfig(cfg)
+	if err != nil {
+		log.Fatal("could not create the http client", zap.Error(err))
+	}
+
+	query := url.Values{}
+	if persist {
+		query.Set("persist", "true")
+	}
+	endpoint := fmt.Sprintf("%s/admin/plugins/%s/%s?%s", utils.BaseURLFromConfig(cfg), url.PathEscape(name), action, query.Encode())
+	resp, err := client.Post(endpoint, "application/json", nil)
+	if err != nil {
+		log.Fatal("could not "+action+" the plugin", zap.Error(err))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal("could not read http response", zap.Error(err))
+	}
+	defer resp.Body.Close()
+
+	result := make(map[string]string)
+	err = json.Unmarshal(b, &result)
+	if err != nil {
+		log.Fatal("could not unmarshal server response", zap.Error(err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatal("could not "+action+" the plugin", zap.String("plugin", name), zap.String("error", result["error"]))
+	}
+
+	output(result)
+}
+
+// functionDescriptors returns the descriptors of the functions of the running plugins, keyed by
+// `plugin.function` and by bare function name when a single plugin exposes it
+func functionDescriptors(client *http.Client, cfg *config.Config) map[string]*types.FunctionDescriptor {
+	resp, err := client.Get(utils.BaseURLFromConfig(cfg) + "/plugins")
+	if err != nil {
+		log.Fatal("could not list the plugins", zap.Error(err))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal("could not read http response", zap.Error(err))
+	}
+	defer resp.Body.Close()
+
+	pluginInfo := make(map[string]types.PluginMetadata)
+	err = json.Unmarshal(b, &pluginInfo)
+	if err != nil {
+		log.Fatal("could not unmarshal server response", zap.Error(err))
+	}
+
+	functions := make(map[string]*types.FunctionDescriptor)
+	owners := make(map[string]int)
+	for name, meta := range pluginInfo {
+		for idx := range meta.Functions {
+			fn := &meta.Functions[idx]
+			functions[name+"."+fn.Name] = fn
+			functions[fn.Name] = fn
+			owners[fn.Name]++
 		}
-		b, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatal("could not read http response", zap.Error(err))
+	}
+	for name, count := range owners {
+		if count > 1 {
+			delete(functions, name)
 		}
-		defer resp.Body.Close()
+	}
 
-		content := make([]types.PowerlineReturn, 0)
-		err = json.Unmarshal(b, &content)
+	return functions
+}
+
+// functionArgs returns the arguments of each function, given as `key=value` for
+// every function or as `function:key=value` for a single one, which wins over
+// the arguments given to every function
+func functionArgs(functions []string, args []string) (map[string]map[string]string, error) {
+	shared := make(map[string]string)
+	scoped := make(map[string]map[string]string, len(functions))
+	for _, function := range functions {
+		scoped[function] = make(map[string]string)
+	}
+
+	for _, arg := range args {
+		key, value := arg, ""
+		if idx := strings.Index(arg, "="); idx >= 0 {
+			key, value = arg[:idx], arg[idx+1:]
+		}
+
+		idx := strings.Index(key, ":")
+		if idx < 0 {
+			shared[key] = value
+			continue
+		}
+		function, key := key[:idx], key[idx+1:]
+		if _, ok := scoped[function]; !ok {
+			return nil, fmt.Errorf("argument %s is given to %s, which is not rendered", arg, function)
+		}
+		scoped[function][key] = value
+	}
+
+	result := make(map[string]map[string]string, len(functions))
+	for _, function := range functions {
+		result[function] = make(map[string]string, len(shared)+len(scoped[function]))
+		for key, value := range shared {
+			result[function][key] = value
+		}
+		for key, value := range scoped[function] {
+			result[function][key] = value
+		}
+	}
+	return result, nil
+}
+
+// coerceArgs converts the arguments given as strings to the types of the parameters
+// of the function, they are left as strings when the function is not known
+func coerceArgs(fn *types.FunctionDescriptor, args map[string]string) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(args))
+	if fn == nil {
+		for name, value := range args {
+			result[name] = value
+		}
+		return result, nil
+	}
+
+	var errs error
+	for name, value := range args {
+		param, ok := fn.Parameter(name)
+		if !ok {
+			// the schema of the function decides whether it is allowed
+			result[name] = value
+			continue
+		}
+		parsed, err := param.Parse(value)
 		if err != nil {
-			log.Fatal("could not unmarshal server response", zap.Error(err))
+			errs = multierr.Append(errs, err)
+			continue
 		}
+		result[name] = parsed
+	}
+	if errs != nil {
+		return nil, errs
+	}
 
-		output(content)
-	},
+	if err := fn.ArgumentsSchema().Validate("args", result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func formatRequired(required bool) string {
+	if required {
+		return "yes"
+	}
+	return ""
+}
+
+func formatDefault(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// parameterHelp returns the description of the parameter along with the values it accepts
+func parameterHelp(param types.ParameterDescriptor) string {
+	if len(param.Enum) == 0 {
+		return param.Description
+	}
+
+	choices := make([]string, 0, len(param.Enum))
+	for _, choice := range param.Enum {
+		choices = append(choices, fmt.Sprintf("%v", choice))
+	}
+	help := "one of " + strings.Join(choices, ", ")
+	if param.Description != "" {
+		help = param.Description + ", " + help
+	}
+	return help
+}
+
+// postJSON posts a request to the server and decodes its response into result
+func postJSON(client *http.Client, url string, request interface{}, result interface{}) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		log.Fatal("could not marshal request", zap.Error(err))
+	}
+
+	resp, err := client.Post(url, "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		log.Fatal("could not query the server", zap.Error(err))
+	}
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal("could not read http response", zap.Error(err))
+	}
+	defer resp.Body.Close()
+
+	err = json.Unmarshal(b, result)
+	if err != nil {
+		log.Fatal("could not unmarshal server response", zap.Error(err))
+	}
 }
 
 func initPluginCommand() {
-	pluginRunFunction.PersistentFlags().StringSliceVarP(&runArgs, "arg", "a", []string{}, "Arguments to pass in a key=value format")
+	pluginRunFunction.PersistentFlags().StringSliceVarP(&runArgs, "arg", "a", []string{}, "Arguments to pass in a key=value format, or function:key=value to pass them to a single function")
+	pluginRunFunction.PersistentFlags().BoolVarP(&runBatch, "batch", "b", false, "Use the batch endpoint even for a single function")
+	pluginEnableCmd.Flags().BoolVar(&adminPersist, "persist", false, "Keep the plugin enabled when the server restarts")
+	pluginDisableCmd.Flags().BoolVar(&adminPersist, "persist", false, "Keep the plugin disabled when the server restarts")
 
 	pluginCmd.AddCommand(pluginListCmd)
 	pluginCmd.AddCommand(pluginFunctionsCmd)
 	pluginCmd.AddCommand(pluginRunFunction)
+	pluginCmd.AddCommand(pluginEnableCmd)
+	pluginCmd.AddCommand(pluginDisableCmd)
+	pluginCmd.AddCommand(pluginRestartCmd)
 }
@@ -6,6 +6,7 @@ import (
 	"path"
 
 	"github.com/spf13/cobra"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
 	"go.uber.org/zap"
 )
 
@@ -22,6 +23,10 @@ var rootCmd = &cobra.Command{
 	Use:   "gowerline",
 	Short: "generate powerline segments from Go !",
 	Long:  ``,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		configFile = paths.Expand(configFile)
+		pluginsDir = paths.Expand(pluginsDir)
+	},
 }
 
 func Execute() {
@@ -37,8 +42,8 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
-	defaultPluginDir := path.Join(homeDir, ".gowerline", "plugins")
-	defaultConfigFile := path.Join(homeDir, ".gowerline", "gowerline.yaml")
+	defaultPluginDir := path.Join(paths.DataDir(), "plugins")
+	defaultConfigFile := path.Join(paths.ConfigDir(), "gowerline.yaml")
 
 	log, err = zap.NewProduction()
 	if err != nil {
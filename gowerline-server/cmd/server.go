@@ -1,14 +1,18 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"os/user"
 	"path"
-	"path/filepath"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -17,9 +21,12 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/thomas-maurice/gowerline/gowerline-server/config"
 	"github.com/thomas-maurice/gowerline/gowerline-server/handlers"
-	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/logging"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
 	"github.com/thomas-maurice/gowerline/gowerline-server/version"
-	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -37,11 +44,24 @@ var serverRunCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		gin.SetMode(gin.ReleaseMode)
 
+		// used until the logs are set up as configured
 		log, err := zap.NewProduction()
 		if err != nil {
 			panic(err)
 		}
 
+		cfg, err := config.NewConfigFromFile(configFile)
+		if err != nil {
+			log.Panic("could not load config", zap.Error(err))
+		}
+
+		logs, err := logging.New(cfg.LogSettings())
+		if err != nil {
+			log.Panic("could not set up the logs", zap.Error(err))
+		}
+		defer logs.Close()
+		log = logs.Logger()
+
 		log.Info(
 			"starting gowerline server",
 			zap.String("version", version.Version),
@@ -52,139 +72,417 @@ var serverRunCmd = &cobra.Command{
 			zap.String("target_arch", version.Arch),
 		)
 
-		cfg, err := config.NewConfigFromFile(configFile)
+		// The server being upgraded, if any, hands over its listeners and its lock
+		handover, err := utils.InheritedHandover()
 		if err != nil {
-			log.Panic("could not load config", zap.Error(err))
+			log.Panic("could not use what the previous server handed over", zap.Error(err))
+		}
+
+		// Only one server may use the storage of the plugins at a time, the
+		// lock is released by the kernel whenever the process exits
+		var lock *os.File
+		if handover != nil {
+			lock = handover.Lock
+		} else {
+			lock, err = utils.LockFile(paths.Expand(lockFile))
 		}
+		if errors.Is(err, utils.ErrLocked) {
+			pid, _ := runningServer()
+			log.Fatal("another server is already running, stop it first", zap.Int("pid", pid), zap.String("lockfile", lockFile))
+		} else if err != nil {
+			log.Panic("could not lock the lock file", zap.Error(err))
+		}
+		defer lock.Close()
 
-		// TODO: use this to control timeouts
+		// Lifecycle context of the plugins, calls are bounded
+		// by the request context and the configured timeouts
 		ctx := context.Background()
 
-		pluginMap := make(map[string]*plugins.Plugin)
-		pluginList := make([]*plugins.Plugin, 0)
-		for _, plgCfg := range cfg.Plugins {
-			if plgCfg.Disabled {
-				log.Info("skipping disabled pluigin", zap.String("plugin", plgCfg.Name))
-				continue
-			}
+		mgr := manager.NewManager(logs, configFile, pluginsDir, homeDir)
 
-			storageDir := path.Join(homeDir, ".gowerline", "storage")
-			if _, err := os.Stat(storageDir); os.IsNotExist(err) {
-				err = os.Mkdir(storageDir, 0744)
-				if err != nil {
-					log.Fatal("could not create the storage directrory", zap.Error(err))
-				}
+		r := gin.New()
+
+		// every request is logged at the info level
+		ginLevel := zapcore.ErrorLevel
+		if cfg.Debug {
+			ginLevel = zapcore.InfoLevel
+		}
+		ginLogger := logs.LoggerAt(ginLevel)
+		r.Use(ginzap.Ginzap(ginLogger, time.RFC3339, true))
+		r.Use(ginzap.RecoveryWithZap(log, true))
+
+		// Requests made over TCP are checked before anything else
+		var token string
+		if cfg.Listen.Token {
+			token, err = utils.LoadOrCreateToken(cfg.Listen.TokenPath())
+			if err != nil {
+				log.Panic("could not load the token", zap.Error(err))
 			}
+		}
+		r.Use(handlers.BuildTCPGuard(log, token))
+
+		err = handlers.SetupHandlers(r, ctx, log, mgr)
+		if err != nil {
+			log.Panic("could not setup handlers", zap.Error(err))
+		}
+
+		listeners, listenPath, activated := listen(log, cfg, handover)
 
-			plgDB, err := bolt.Open(path.Join(storageDir, fmt.Sprintf("%s.db", plgCfg.Name)), 0660, nil)
+		err = utils.WritePidFile(paths.Expand(pidFile))
+		if err != nil {
+			log.Error("could not write the pid file", zap.String("pidfile", pidFile), zap.Error(err))
+		}
+
+		// Plugins are started in the background and are registered as starting before
+		// we serve, so that the first prompts get a placeholder rather than waiting for
+		// the slow ones. After an upgrade the previous server keeps serving until they
+		// are started, once it released their storage.
+		if handover != nil {
+			err = handover.Release()
 			if err != nil {
-				log.Fatal("could not create plugin database for plugin", zap.Error(err), zap.String("plugin", plgCfg.Name))
+				log.Error("the previous server did not release the plugins, starting them anyway", zap.Error(err))
 			}
-			defer plgDB.Close()
-
-			plgPath := path.Join(pluginsDir, plgCfg.Name)
-			plg, err := plugins.NewPlugin(ctx, log, plgPath, &plugins.PluginConfig{
-				UserHome:     homeDir,
-				GowerlineDir: path.Join(homeDir, ".gowerline"),
-				StorageDir:   storageDir,
-				PluginName:   plgCfg.Name,
-				Config:       plgCfg.Config,
-				BoltDB:       plgDB,
-			})
+			err = mgr.Apply(ctx, cfg)
 			if err != nil {
-				log.Panic(fmt.Sprintf("could not load plugin %s", plgCfg.Name), zap.Error(err))
+				log.Error("some plugins could not be loaded", zap.Error(err))
 			}
-			startData, err := plg.RunStart(ctx, log)
+		} else {
+			applied := mgr.ApplyInBackground(ctx, cfg)
+			go func() {
+				err := <-applied
+				if err != nil {
+					log.Error("some plugins could not be loaded", zap.Error(err))
+				}
+			}()
+		}
+
+		conns := utils.NewConnTracker()
+		srv := &http.Server{Handler: r, ConnState: conns.ConnState}
+		serving := &sync.WaitGroup{}
+		for _, listener := range listeners {
+			listener := listener
+			serving.Add(1)
+			go func() {
+				defer serving.Done()
+				err := srv.Serve(listener)
+				if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+					log.Panic("could not serve", zap.Error(err))
+				}
+			}()
+		}
+
+		if handover != nil {
+			err = handover.Ready()
 			if err != nil {
-				log.Panic(fmt.Sprintf("could not load plugin %s", plgCfg.Name), zap.Error(err))
+				log.Error("could not tell the previous server that this one is ready", zap.Error(err))
 			}
+		}
 
-			plg.Metadata = startData.Metadata
-
-			log.Info(
-				"loaded plugin",
-				zap.String("plugin", plgCfg.Name),
-				zap.String("version", startData.Metadata.Version),
-				zap.String("author", startData.Metadata.Author),
-			)
-
-			for _, fn := range startData.Metadata.Functions {
-				log.Info(
-					"registered new function for plugin",
-					zap.String("plugin", plgCfg.Name),
-					zap.String("function", fn.Name),
-				)
-				pluginMap[fn.Name] = plg
+		// Reloads run one at a time away from the signals, so that the server
+		// can still be stopped while a slow plugin is reloaded. The signals
+		// caught during a reload trigger a single reload afterwards.
+		reloads := make(chan struct{}, 1)
+		reloading := make(chan struct{})
+		go func() {
+			defer close(reloading)
+			for range reloads {
+				err := mgr.Reload(ctx)
+				if err != nil {
+					log.Error("failed to reload configuration", zap.Error(err))
+				}
 			}
-			pluginList = append(pluginList, plg)
+		}()
+
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+		upgraded := false
+		for sig := range signalChan {
+			if sig == syscall.SIGHUP {
+				log.Info("caught signal, reloading configuration", zap.String("signal", sig.String()))
+				select {
+				case reloads <- struct{}{}:
+				default:
+				}
+				continue
+			}
+
+			if sig == syscall.SIGUSR2 {
+				log.Info("caught signal, upgrading", zap.String("signal", sig.String()))
+				if activated {
+					// systemd would stop the new server along with this one
+					log.Error("cannot upgrade a server socket activated by systemd, restart the unit instead")
+					continue
+				}
+				// the new server asks for the plugins once it is up, this
+				// one answers with their last results until it is ready
+				released := false
+				pid, err := utils.Upgrade(listeners, lock, mgr.Config().StartupSettings().Timeout, func() {
+					released = true
+					err := mgr.Release(ctx)
+					if err != nil {
+						log.Error("failed to stop plugins", zap.Error(err))
+					}
+				})
+				if err != nil {
+					log.Error("could not upgrade, still serving", zap.Error(err))
+					if released {
+						resumed := mgr.Resume(ctx)
+						go func() {
+							err := <-resumed
+							if err != nil {
+								log.Error("some plugins could not be loaded", zap.Error(err))
+							}
+						}()
+					}
+					continue
+				}
+				log.Info("the new server is ready, exiting", zap.Int("pid", pid))
+				upgraded = true
+				break
+			}
+
+			log.Info("caught signal, exiting", zap.String("signal", sig.String()))
+			break
 		}
+		signal.Stop(signalChan)
 
-		r := gin.New()
+		// A reload still queued would start the plugins again once they are
+		// stopped, it is dropped, and the one in progress is waited for below
+		select {
+		case <-reloads:
+		default:
+		}
+		close(reloads)
 
-		ginLoggerConfig := zap.NewProductionConfig()
-		if cfg.Debug {
-			ginLoggerConfig.Level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
-		} else {
-			ginLoggerConfig.Level = zap.NewAtomicLevelAt(zapcore.ErrorLevel)
+		// Stop accepting new requests and let the in-flight calls complete
+		// before stopping the plugins they might be waiting on. The listeners
+		// are closed first so that the connections accepted until then are all
+		// known once Serve returns, the shared ones keep the others waiting for
+		// the new server after an upgrade. Their requests are served before the
+		// shutdown, which would drop the ones it has not read yet.
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		serving.Wait()
+		srv.SetKeepAlivesEnabled(false)
+		// the timeout may have been changed by a reload
+		shutdownCtx, cancel := context.WithTimeout(ctx, mgr.Config().ShutdownTimeout())
+		defer cancel()
+		err = conns.WaitIdle(shutdownCtx)
+		if err == nil {
+			err = srv.Shutdown(shutdownCtx)
 		}
-		ginLogger, err := ginLoggerConfig.Build()
 		if err != nil {
-			log.Panic("could not setup gin logger", zap.Error(err))
+			log.Error("in-flight requests did not complete in time", zap.Error(err))
 		}
-		r.Use(ginzap.Ginzap(ginLogger, time.RFC3339, true))
-		r.Use(ginzap.RecoveryWithZap(log, true))
 
-		err = handlers.SetupHandlers(r, ctx, log, pluginMap)
+		// the new server serves on the socket after an upgrade
+		if listenPath != "" && !upgraded {
+			err = os.Remove(listenPath)
+			if err != nil && !os.IsNotExist(err) {
+				log.Error("could not remove the unix socket", zap.String("socket", listenPath), zap.Error(err))
+			} else {
+				log.Info("closed unix socket", zap.String("socket", listenPath))
+			}
+		}
+
+		<-reloading
+		err = mgr.StopAll(ctx)
 		if err != nil {
-			log.Panic("could not setup handlers", zap.Error(err))
+			log.Error("failed to stop plugins", zap.Error(err))
 		}
 
-		go func() {
-			if cfg.Listen.Unix != "" {
-				var listenPath string
-				currentUser, err := user.Current()
+		err = utils.RemovePidFile(paths.Expand(pidFile))
+		if err != nil {
+			log.Error("could not remove the pid file", zap.String("pidfile", pidFile), zap.Error(err))
+		}
+
+		log.Info("server stopped")
+	},
+}
+
+// listen returns the listeners of the server: the ones of the previous server when it is
+// upgraded, the sockets passed by systemd when it is socket activated, and the unix socket
+// and port of the configuration otherwise. The path of the unix socket to remove on exit
+// is returned along with them, if any, and whether they were passed by systemd.
+func listen(log *zap.Logger, cfg *config.Config, handover *utils.Handover) ([]net.Listener, string, bool) {
+	if handover != nil {
+		listeners := make([]net.Listener, 0, len(handover.Listeners))
+		listenPath := ""
+		for _, listener := range handover.Listeners {
+			log.Info("using listener handed over by the previous server", zap.String("address", listener.Addr().String()))
+			if _, ok := listener.(*net.UnixListener); ok {
+				if listener.Addr().String() == paths.Expand(cfg.Listen.Unix) {
+					listenPath = listener.Addr().String()
+				}
+				var err error
+				listener, err = utils.CheckPeerCredentials(log, listener, &cfg.Listen)
 				if err != nil {
-					log.Panic("could not get current user", zap.Error(err))
+					log.Panic("could not listen", zap.Error(err))
 				}
-				homeDir := currentUser.HomeDir
+			}
+			listeners = append(listeners, listener)
+		}
+		return listeners, listenPath, false
+	}
 
-				if strings.HasPrefix(cfg.Listen.Unix, "~/") {
-					listenPath = filepath.Join(homeDir, cfg.Listen.Unix[2:])
+	activated, err := utils.ActivationListeners()
+	if err != nil {
+		log.Panic("could not use the sockets passed by systemd", zap.Error(err))
+	}
+	if len(activated) != 0 {
+		listeners := make([]net.Listener, 0, len(activated))
+		for _, listener := range activated {
+			log.Info("using socket passed by systemd", zap.String("address", listener.Addr().String()))
+			if _, ok := listener.(*net.UnixListener); ok {
+				if listener.Addr().String() != paths.Expand(cfg.Listen.Unix) {
+					log.Warn("the socket passed by systemd is not the one of the configuration, which the clients connect to", zap.String("socket", paths.Expand(cfg.Listen.Unix)))
 				}
-
-				log.Info("listening on an unix socket", zap.String("socket", listenPath))
-				os.Remove(listenPath)
-				err = r.RunUnix(listenPath)
+				listener, err = utils.CheckPeerCredentials(log, listener, &cfg.Listen)
 				if err != nil {
 					log.Panic("could not listen", zap.Error(err))
 				}
+			}
+			listeners = append(listeners, listener)
+		}
+		// systemd owns the sockets, they outlive the server
+		return listeners, "", true
+	}
 
-				log.Info("closed unix socket")
+	var listeners []net.Listener
+	listenPath := paths.Expand(cfg.Listen.Unix)
+	if listenPath != "" {
+		log.Info("listening on an unix socket", zap.String("socket", listenPath))
+		listener, err := utils.ListenUnix(log, listenPath, &cfg.Listen)
+		if errors.Is(err, utils.ErrSocketInUse) {
+			log.Fatal("another server is already listening on the socket", zap.String("socket", listenPath))
+		} else if err != nil {
+			log.Panic("could not listen", zap.Error(err))
+		}
+		listeners = append(listeners, listener)
+	}
+	// the port is used alongside the socket when both are set
+	if cfg.Listen.Port != 0 || cfg.Listen.Unix == "" {
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", cfg.Listen.Port))
+		if err != nil {
+			log.Panic("could not listen", zap.Error(err))
+		}
+		log.Info("listening on tcp", zap.String("address", listener.Addr().String()), zap.Bool("token", cfg.Listen.Token))
+		listeners = append(listeners, listener)
+	}
 
-				return
-			}
+	return listeners, listenPath, false
+}
 
-			err = r.Run(fmt.Sprintf("127.0.0.1:%d", cfg.Listen.Port))
-			if err != nil {
-				log.Panic("could not listen", zap.Error(err))
-			}
-			log.Info("closed socket")
-		}()
+var serverReloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reloads the server's configuration",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
+		if err != nil {
+			log.Panic("could not load config", zap.Error(err))
+		}
 
-		signalChan := make(chan os.Signal, 1)
-		signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
-		sig := <-signalChan
-		log.Info("caught signal", zap.String("signal, exiting", sig.String()))
-		for _, plg := range pluginList {
-			log.Info("stopping plugin", zap.String("plugin", plg.Name))
-			err := plg.RunStop(ctx, log)
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
+
+		resp, err := client.Post(utils.BaseURLFromConfig(cfg)+"/admin/reload", "application/json", nil)
+		if err != nil {
+			log.Fatal("could not reload the server", zap.Error(err))
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal("could not read http response", zap.Error(err))
+		}
+		defer resp.Body.Close()
+
+		result := make(map[string]string)
+		err = json.Unmarshal(b, &result)
+		if err != nil {
+			log.Fatal("could not unmarshal server response", zap.Error(err))
+		}
+
+		output(result)
+	},
+}
+
+// logLevelPlugin is the plugin whose level `server loglevel` changes
+var logLevelPlugin string
+
+var serverLogLevelCmd = &cobra.Command{
+	Use:   "loglevel [level]",
+	Short: "Changes the level of the server's logs, or shows the current levels",
+	Long: `Changes the level of the logs of the server, or of a single plugin with --plugin, to a level such as
+debug, info or warn. The default level makes the plugin log at the level of the server again. The levels
+are set back to the configured ones when the configuration is reloaded.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
+		if err != nil {
+			log.Panic("could not load config", zap.Error(err))
+		}
+
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
+
+		var resp *http.Response
+		if len(args) == 0 {
+			resp, err = client.Get(utils.BaseURLFromConfig(cfg) + "/admin/loglevel")
+		} else {
+			var b []byte
+			b, err = json.Marshal(types.LogLevelRequest{Level: args[0], Plugin: logLevelPlugin})
 			if err != nil {
-				log.Error("failed to stop plugin", zap.String("plugin", plg.Name))
+				log.Fatal("could not marshal request", zap.Error(err))
 			}
+			resp, err = client.Post(utils.BaseURLFromConfig(cfg)+"/admin/loglevel", "application/json", bytes.NewReader(b))
+		}
+		if err != nil {
+			log.Fatal("could not query the server", zap.Error(err))
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal("could not read http response", zap.Error(err))
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			result := make(map[string]string)
+			_ = json.Unmarshal(b, &result)
+			log.Fatal("could not change the log level", zap.String("error", result["error"]))
+		}
+
+		var levels types.LogLevels
+		err = json.Unmarshal(b, &levels)
+		if err != nil {
+			log.Fatal("could not unmarshal server response", zap.Error(err))
 		}
+
+		output(levels)
 	},
 }
 
 func initServerCmd() {
+	serverCmd.PersistentFlags().StringVar(&pidFile, "pidfile", path.Join(paths.RuntimeDir(), "gowerline.pid"), "File holding the pid of the server")
+	serverCmd.PersistentFlags().StringVar(&lockFile, "lockfile", path.Join(paths.StateDir(), "server.lock"), "File locked by the server so that only one runs at a time")
+	serverCmd.PersistentFlags().StringVar(&logFile, "log-file", path.Join(paths.StateDir(), "server.log"), "File the output of the server goes to when it runs in the background")
+	serverStartCmd.Flags().DurationVar(&startWait, "wait", 10*time.Second, "How long to wait for the server to answer")
+	serverStopCmd.Flags().DurationVar(&stopTimeout, "timeout", 30*time.Second, "How long to wait for the server to stop")
+	serverRestartCmd.Flags().DurationVar(&startWait, "wait", 10*time.Second, "How long to wait for the server to answer")
+	serverRestartCmd.Flags().DurationVar(&stopTimeout, "timeout", 30*time.Second, "How long to wait for the server to stop")
+	serverUpgradeCmd.Flags().DurationVar(&stopTimeout, "timeout", time.Minute, "How long to wait for the server to be replaced")
+	serverLogLevelCmd.Flags().StringVar(&logLevelPlugin, "plugin", "", "Plugin whose level changes, rather than the server's")
+
 	serverCmd.AddCommand(serverRunCmd)
+	serverCmd.AddCommand(serverReloadCmd)
+	serverCmd.AddCommand(serverStartCmd)
+	serverCmd.AddCommand(serverStopCmd)
+	serverCmd.AddCommand(serverRestartCmd)
+	serverCmd.AddCommand(serverStatusCmd)
+	serverCmd.AddCommand(serverUpgradeCmd)
+	serverCmd.AddCommand(serverLogLevelCmd)
 }
@@ -28,14 +28,19 @@ var versionCmd = &cobra.Command{
 			Architecture:    version.Arch,
 		}
 
-		cfg, err := config.NewConfigFromFile(configFile)
+		cfg, err := config.NewUnresolvedConfigFromFile(configFile)
 		if err != nil {
 			data["server_version"] = err.Error()
 			output(data)
 			log.Panic("could not load config", zap.Error(err))
 		}
 
-		client := utils.NewHTTPClientFromConfig(cfg)
+		client, err := utils.NewHTTPClientFromConfig(cfg)
+		if err != nil {
+			data["server_version"] = err.Error()
+			output(data)
+			log.Fatal("could not create the http client", zap.Error(err))
+		}
 
 		resp, err := client.Get(utils.BaseURLFromConfig(cfg) + "/version")
 		if err != nil {
@@ -1,33 +1,326 @@
 package config
 
 import (
-	"io/ioutil"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// TransportNative loads the plugin as a Go plugin (.so file)
+	// in the server's own process, this is the default
+	TransportNative = "native"
+	// TransportGRPC spawns the plugin as a child process and talks
+	// to it over gRPC on a private unix socket
+	TransportGRPC = "grpc"
+
+	// DefaultCallTimeout is how long a plugin has to render
+	// a segment unless configured otherwise
+	DefaultCallTimeout = 2 * time.Second
+	// DefaultStopTimeout is how long a plugin has to stop
+	DefaultStopTimeout = 5 * time.Second
+	// DefaultShutdownTimeout is how long the in-flight
+	// requests have to complete when the server exits
+	DefaultShutdownTimeout = 10 * time.Second
+
+	// DefaultStartupTimeout is how long a plugin has to start
+	DefaultStartupTimeout = 30 * time.Second
+	// DefaultLoadingPlaceholder is rendered in place of the
+	// segments of the plugins that are still starting
+	DefaultLoadingPlaceholder = "loading"
+
+	// DefaultBreakerFailures is the number of consecutive failures
+	// after which calls to a plugin are short-circuited
+	DefaultBreakerFailures = 5
+	// DefaultBreakerCooldown is how long calls are short-circuited for
+	DefaultBreakerCooldown = 30 * time.Second
+
+	// tokenFile holds the token required by the TCP listener, in the state directory
+	tokenFile = "token"
+	// DefaultSocketMode only lets the user running the server use the unix socket
+	DefaultSocketMode = 0600
+	// DefaultGroupSocketMode is the mode of the unix socket when a group is set
+	DefaultGroupSocketMode = 0660
+
+	// DefaultLogLevel is the level of the logs unless configured
+	// otherwise, or unless the server runs in debug mode
+	DefaultLogLevel = "info"
+	// DefaultLogFileMaxSize is the size in megabytes past which the log file is rotated
+	DefaultLogFileMaxSize = 10
+	// DefaultLogFileMaxBackups is the number of rotated log files kept around
+	DefaultLogFileMaxBackups = 3
+)
+
+// ConfigBreaker configures the circuit breaker that stops calling
+// plugins that keep failing for a while
+type ConfigBreaker struct {
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// ConfigStartup controls how plugins are started, the server
+// listens right away and starts them in the background
+type ConfigStartup struct {
+	// Timeout is how long each plugin has to start
+	Timeout time.Duration `yaml:"timeout"`
+	// Placeholder is rendered in place of the segments
+	// of the plugins that are still starting
+	Placeholder string `yaml:"placeholder"`
+}
+
+// ConfigLog configures the logs of the server and of the plugins, the levels
+// and the file are set back to these ones when the configuration is reloaded
+type ConfigLog struct {
+	// Level is the level of the logs, such as debug, info or warn
+	Level string `yaml:"level"`
+	// Plugins overrides the level of the logs of
+	// some plugins, keyed by plugin instance name
+	Plugins map[string]string `yaml:"plugins"`
+	// File is where the logs go rather than stderr
+	File ConfigLogFile `yaml:"file"`
+}
+
+// ConfigLogFile configures the log file, it is rotated as it grows
+type ConfigLogFile struct {
+	Path string `yaml:"path"`
+	// MaxSize is the size in megabytes past which the file is rotated
+	MaxSize int `yaml:"maxSize"`
+	// MaxBackups is the number of rotated files kept around
+	MaxBackups int `yaml:"maxBackups"`
+}
+
+// ConfigTimeouts controls how long the server waits for plugins
+// to render segments, and what it renders when they are too slow
+type ConfigTimeouts struct {
+	// Call is the default timeout of every function call
+	Call time.Duration `yaml:"call"`
+	// Placeholder is the content of the segment returned when a
+	// call times out, leave it empty to hide the segment
+	Placeholder string `yaml:"placeholder"`
+	// UseLastResult returns the last successful result of the
+	// function instead of the placeholder when there is one
+	UseLastResult bool `yaml:"useLastResult"`
+	// Stop is how long each plugin has to stop before it is given up on
+	Stop time.Duration `yaml:"stop"`
+	// Shutdown is how long the in-flight requests have to complete on exit
+	Shutdown time.Duration `yaml:"shutdown"`
+}
+
+// ConfigPluginTimeouts overrides the server wide timeouts for a plugin
+type ConfigPluginTimeouts struct {
+	Call      time.Duration            `yaml:"call"`
+	Functions map[string]time.Duration `yaml:"functions"`
+}
+
 type ConfigPlugin struct {
-	Name     string    `yaml:"name"`
-	Disabled bool      `yaml:"disabled"`
-	Config   yaml.Node `yaml:"config"`
+	// Name identifies this instance of the plugin, it namespaces its
+	// functions and names its storage
+	Name string `yaml:"name"`
+	// Plugin is the name of the plugin file to load from the plugins
+	// directory, it defaults to Name
+	Plugin   string `yaml:"plugin"`
+	Disabled bool   `yaml:"disabled"`
+	// Lazy plugins are only started the first time they are called
+	Lazy bool `yaml:"lazy"`
+	// Functions are the functions of a lazy plugin that start it when
+	// called by their bare name, the qualified names always do
+	Functions []string             `yaml:"functions"`
+	Transport string               `yaml:"transport"`
+	Timeouts  ConfigPluginTimeouts `yaml:"timeouts"`
+	// Cache overrides the cache settings the plugin
+	// declares for its functions, keyed by function name
+	Cache  map[string]types.CacheDescriptor `yaml:"cache"`
+	Config yaml.Node                        `yaml:"config"`
+}
+
+// ConfigListen configures where the server listens, on an unix socket, on
+// a port of the loopback interface, or both
+type ConfigListen struct {
+	Port int64  `yaml:"port"`
+	Unix string `yaml:"unix"`
+	// Token requires the requests made over TCP to carry the token
+	// of TokenFile as a bearer token, it is generated when missing
+	Token     bool   `yaml:"token"`
+	TokenFile string `yaml:"tokenFile"`
+	// Mode is the octal mode of the unix socket, 0600 unless Group is set
+	Mode string `yaml:"mode"`
+	// Group owns the unix socket, a group name or id
+	Group string `yaml:"group"`
+	// AllowedUsers can connect to the unix socket along with the user
+	// running the server, user names or ids
+	AllowedUsers []string `yaml:"allowedUsers"`
+}
+
+// SocketMode returns the mode of the unix socket, it is only accessible by
+// the user running the server by default, and by the group when one is set
+func (l *ConfigListen) SocketMode() (os.FileMode, error) {
+	if l.Mode == "" {
+		if l.Group != "" {
+			return DefaultGroupSocketMode, nil
+		}
+		return DefaultSocketMode, nil
+	}
+
+	mode, err := strconv.ParseUint(strings.TrimPrefix(l.Mode, "0o"), 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid socket mode %s, it must be an octal mode such as 0600", l.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// TokenPath returns the path of the file holding the token of the TCP listener
+func (l *ConfigListen) TokenPath() string {
+	if l.TokenFile == "" {
+		return path.Join(paths.StateDir(), tokenFile)
+	}
+	return paths.Expand(l.TokenFile)
 }
 
 type Config struct {
-	Listen struct {
-		Port int64  `yaml:"port"`
-		Unix string `yaml:"unix"`
-	} `yaml:"listen"`
-	Debug   bool           `yaml:"debug"`
-	Plugins []ConfigPlugin `yaml:"plugins"`
+	Listen   ConfigListen   `yaml:"listen"`
+	Debug    bool           `yaml:"debug"`
+	Log      ConfigLog      `yaml:"log"`
+	Timeouts ConfigTimeouts `yaml:"timeouts"`
+	Breaker  ConfigBreaker  `yaml:"breaker"`
+	Startup  ConfigStartup  `yaml:"startup"`
+	// StrictFunctions makes the server refuse to load a plugin that
+	// registers a function another plugin already registered instead
+	// of just warning
+	StrictFunctions bool `yaml:"strictFunctions"`
+	// DiscoverPlugins loads the native plugins of the plugins
+	// directory that are not listed in Plugins, with their defaults
+	DiscoverPlugins bool           `yaml:"discoverPlugins"`
+	Plugins         []ConfigPlugin `yaml:"plugins"`
+
+	// loader is kept around to load the discovered plugins the same way
+	loader *loader
 }
 
+// NewConfigFromFile loads the configuration file along with the files of the conf.d
+// directory next to it and the per plugin configuration files, see loadConfigFile.
+// The references to secrets such as `${env:FINNHUB_TOKEN}` are resolved once the
+// files are merged, except in the disabled plugins.
 func NewConfigFromFile(configFile string) (*Config, error) {
-	configBytes, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return nil, err
+	return loadConfigFile(configFile, true)
+}
+
+// NewUnresolvedConfigFromFile loads the configuration file without resolving the
+// references to secrets, which are left as is. It is meant for the commands that
+// only talk to the server and do not need the configuration of the plugins.
+func NewUnresolvedConfigFromFile(configFile string) (*Config, error) {
+	return loadConfigFile(configFile, false)
+}
+
+// Redact removes the secrets the references of the configuration resolved to from an
+// error, such as the decoding errors of yaml which quote the values they cannot decode
+func (c *Config) Redact(err error) error {
+	if c.loader == nil {
+		return err
+	}
+	return c.loader.redact(err)
+}
+
+// CallTimeout returns the timeout of a function call
+// given the server wide and the plugin configuration
+func (c *Config) CallTimeout(plgCfg *ConfigPlugin, function string) time.Duration {
+	if timeout, ok := plgCfg.Timeouts.Functions[function]; ok && timeout > 0 {
+		return timeout
+	}
+	if plgCfg.Timeouts.Call > 0 {
+		return plgCfg.Timeouts.Call
+	}
+	if c.Timeouts.Call > 0 {
+		return c.Timeouts.Call
+	}
+	return DefaultCallTimeout
+}
+
+// BreakerSettings returns the circuit breaker settings with the defaults applied
+func (c *Config) BreakerSettings() ConfigBreaker {
+	settings := c.Breaker
+	if settings.Failures <= 0 {
+		settings.Failures = DefaultBreakerFailures
+	}
+	if settings.Cooldown <= 0 {
+		settings.Cooldown = DefaultBreakerCooldown
+	}
+	return settings
+}
+
+// PluginFile returns the name of the file in the plugins
+// directory that implements the plugin instance
+func (p *ConfigPlugin) PluginFile() string {
+	if p.Plugin != "" {
+		return p.Plugin
+	}
+	return p.Name
+}
+
+// StartupSettings returns the startup settings with the defaults applied
+func (c *Config) StartupSettings() ConfigStartup {
+	settings := c.Startup
+	if settings.Timeout <= 0 {
+		settings.Timeout = DefaultStartupTimeout
 	}
+	if settings.Placeholder == "" {
+		settings.Placeholder = DefaultLoadingPlaceholder
+	}
+	return settings
+}
+
+// LogSettings returns the log settings with the defaults applied, the logs are
+// at the debug level by default when the server runs in debug mode
+func (c *Config) LogSettings() ConfigLog {
+	settings := c.Log
+	if settings.Level == "" {
+		settings.Level = DefaultLogLevel
+		if c.Debug {
+			settings.Level = "debug"
+		}
+	}
+	if settings.File.Path != "" {
+		settings.File.Path = paths.Expand(settings.File.Path)
+	}
+	if settings.File.MaxSize <= 0 {
+		settings.File.MaxSize = DefaultLogFileMaxSize
+	}
+	if settings.File.MaxBackups <= 0 {
+		settings.File.MaxBackups = DefaultLogFileMaxBackups
+	}
+	return settings
+}
 
-	var cfg Config
-	err = yaml.Unmarshal(configBytes, &cfg)
-	return &cfg, err
+// StopTimeout returns how long a plugin has to stop
+func (c *Config) StopTimeout() time.Duration {
+	if c.Timeouts.Stop > 0 {
+		return c.Timeouts.Stop
+	}
+	return DefaultStopTimeout
+}
+
+// ShutdownTimeout returns how long the in-flight requests have to complete on exit
+func (c *Config) ShutdownTimeout() time.Duration {
+	if c.Timeouts.Shutdown > 0 {
+		return c.Timeouts.Shutdown
+	}
+	return DefaultShutdownTimeout
+}
+
+// CacheSettings returns how the results of a function are cached,
+// the configuration takes precedence over what the plugin declares
+func (c *Config) CacheSettings(plgCfg *ConfigPlugin, fn *types.FunctionDescriptor) types.CacheDescriptor {
+	if settings, ok := plgCfg.Cache[fn.Name]; ok {
+		return settings
+	}
+	if fn.Cache != nil {
+		return *fn.Cache
+	}
+	return types.CacheDescriptor{}
 }
@@ -0,0 +1,365 @@
+package config
+
+import (
+	"debug/elf"
+	"debug/macho"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// confDir is the directory next to the configuration file whose
+	// files are merged into it, in the lexical order of their names
+	confDir = "conf.d"
+	// pluginConfigSuffix is the suffix of the files next to the configuration
+	// file that hold the `config` of a plugin, such as `finnhub.yaml`
+	pluginConfigSuffix = ".yaml"
+	// nativePluginSuffix is the optional suffix of native plugin files
+	nativePluginSuffix = ".so"
+)
+
+// loader assembles the configuration from the configuration file, the files
+// of the conf.d directory and the per plugin configuration files
+type loader struct {
+	configFile string
+	dir        string
+	resolve    bool
+	// sources tracks the file every node comes from, so that the
+	// errors point at the right file once they are all merged
+	sources map[*yaml.Node]string
+	// secrets are what the references resolved to, along with the
+	// values that held them
+	secrets []string
+}
+
+// loadConfigFile builds the configuration out of, in this order:
+//   - the configuration file itself
+//   - the `*.yaml` files of the conf.d directory next to it, in the lexical order
+//     of their names, which are merged into it with mergeRoot
+//   - the `<plugin name>.yaml` files next to it, which hold the `config` of the
+//     plugins, what the entry of the plugin sets under `config` takes precedence
+func loadConfigFile(configFile string, resolve bool) (*Config, error) {
+	l := &loader{
+		configFile: configFile,
+		dir:        path.Dir(configFile),
+		resolve:    resolve,
+		sources:    make(map[*yaml.Node]string),
+	}
+
+	root, err := l.readFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		root = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+
+	confFiles, err := filepath.Glob(path.Join(l.dir, confDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(confFiles)
+	for _, confFile := range confFiles {
+		node, err := l.readFile(confFile)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			continue
+		}
+		if err := mergeRoot(root, node); err != nil {
+			return nil, fmt.Errorf("%s: %w", confFile, err)
+		}
+	}
+
+	if plugins := mappingValue(root, "plugins"); plugins != nil && plugins.Kind == yaml.SequenceNode {
+		for _, plugin := range plugins.Content {
+			if err := l.mergePluginFile(plugin); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if l.resolve {
+		if err := l.resolveDocument(root); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg Config
+	if err := root.Decode(&cfg); err != nil {
+		return nil, l.redact(err)
+	}
+	cfg.loader = l
+
+	return &cfg, nil
+}
+
+// readFile reads a yaml file and returns its root node, nil when the file is empty
+func (l *loader) readFile(file string) (*yaml.Node, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	l.track(root, file)
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return nil, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: the configuration must be a map", file)
+	}
+
+	return root, nil
+}
+
+func (l *loader) track(node *yaml.Node, file string) {
+	l.sources[node] = file
+	for _, child := range node.Content {
+		l.track(child, file)
+	}
+}
+
+// mergePluginFile merges the per plugin configuration file, if there is one, under
+// the `config` of the plugin entry. What the entry sets itself takes precedence.
+func (l *loader) mergePluginFile(plugin *yaml.Node) error {
+	name := mappingValue(plugin, "name")
+	if name == nil || name.Kind != yaml.ScalarNode || name.Value == "" {
+		return nil
+	}
+
+	file := path.Join(l.dir, name.Value+pluginConfigSuffix)
+	if path.Clean(file) == path.Clean(l.configFile) {
+		return nil
+	}
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil
+	}
+
+	node, err := l.readFile(file)
+	if err != nil || node == nil {
+		return err
+	}
+
+	if existing := mappingValue(plugin, "config"); existing != nil && !isNull(existing) {
+		if err := mergeNodes(node, existing); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	setMappingValue(plugin, "config", node)
+
+	return nil
+}
+
+// mergeRoot merges a configuration into another one, see mergeNodes. The plugins
+// are merged by name, the entries of plugins that are not configured yet are
+// appended to the list.
+func mergeRoot(dst *yaml.Node, src *yaml.Node) error {
+	for idx := 0; idx+1 < len(src.Content); idx += 2 {
+		key, value := src.Content[idx], src.Content[idx+1]
+		existing := mappingValue(dst, key.Value)
+		if key.Value != "plugins" || existing == nil || existing.Kind != yaml.SequenceNode || value.Kind != yaml.SequenceNode {
+			if err := mergeValue(dst, key, value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, plugin := range value.Content {
+			target := findPlugin(existing, plugin)
+			if target == nil {
+				existing.Content = append(existing.Content, plugin)
+				continue
+			}
+			if err := mergeNodes(target, plugin); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeNodes merges the src mapping into the dst one: the maps are merged key
+// by key, and any other value of src, lists included, replaces the one of dst
+func mergeNodes(dst *yaml.Node, src *yaml.Node) error {
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: cannot merge a %s into a %s", src.Line, kindName(src), kindName(dst))
+	}
+
+	for idx := 0; idx+1 < len(src.Content); idx += 2 {
+		if err := mergeValue(dst, src.Content[idx], src.Content[idx+1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func mergeValue(dst *yaml.Node, key *yaml.Node, value *yaml.Node) error {
+	existing := mappingValue(dst, key.Value)
+	if existing != nil && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+		return mergeNodes(existing, value)
+	}
+	if existing != nil {
+		setMappingValue(dst, key.Value, value)
+		return nil
+	}
+	dst.Content = append(dst.Content, key, value)
+	return nil
+}
+
+// findPlugin returns the entry of the list that has the same name as plugin
+func findPlugin(plugins *yaml.Node, plugin *yaml.Node) *yaml.Node {
+	name := mappingValue(plugin, "name")
+	if name == nil {
+		return nil
+	}
+	for _, candidate := range plugins.Content {
+		candidateName := mappingValue(candidate, "name")
+		if candidateName != nil && candidateName.Value == name.Value {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if node.Content[idx].Value == key {
+			return node.Content[idx+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if node.Content[idx].Value == key {
+			node.Content[idx+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func kindName(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "map"
+	case yaml.SequenceNode:
+		return "list"
+	}
+	return "value"
+}
+
+// AddDiscoveredPlugins adds an entry for every native plugin of the plugins directory
+// that is not configured yet, their configuration is read from their per plugin
+// configuration file if there is one. Plugins that run out of process cannot be
+// told apart from other executables, so they have to be configured explicitly.
+func (c *Config) AddDiscoveredPlugins(pluginsDir string) error {
+	entries, err := ioutil.ReadDir(pluginsDir)
+	if err != nil {
+		return err
+	}
+
+	configured := make(map[string]bool)
+	for _, plgCfg := range c.Plugins {
+		configured[plgCfg.Name] = true
+		configured[plgCfg.PluginFile()] = true
+	}
+
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !isSharedObject(path.Join(pluginsDir, entry.Name())) {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), nativePluginSuffix)
+		if configured[name] || configured[entry.Name()] {
+			continue
+		}
+
+		plgCfg, err := c.discoveredPlugin(name, entry.Name())
+		if err != nil {
+			return err
+		}
+		c.Plugins = append(c.Plugins, plgCfg)
+		configured[name] = true
+	}
+
+	return nil
+}
+
+func (c *Config) discoveredPlugin(name string, file string) (ConfigPlugin, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	setMappingValue(node, "name", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name})
+	setMappingValue(node, "plugin", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: file})
+
+	l := c.loader
+	if l == nil {
+		l = &loader{sources: make(map[*yaml.Node]string)}
+	}
+	if l.dir != "" {
+		if err := l.mergePluginFile(node); err != nil {
+			return ConfigPlugin{}, err
+		}
+	}
+	if l.resolve {
+		if err := l.resolveReferences(node); err != nil {
+			return ConfigPlugin{}, err
+		}
+	}
+
+	var plgCfg ConfigPlugin
+	err := node.Decode(&plgCfg)
+	return plgCfg, l.redact(err)
+}
+
+// isSharedObject tells whether the file is a shared library, which is what
+// native plugins are built as, as opposed to the plugins built as executables
+func isSharedObject(file string) bool {
+	if f, err := macho.Open(file); err == nil {
+		defer f.Close()
+		return f.Type == macho.TypeDylib || f.Type == macho.TypeBundle
+	}
+
+	f, err := elf.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_DYN {
+		return false
+	}
+	// position independent executables are ET_DYN as well, but need an interpreter
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_INTERP {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,320 @@
+package config
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeELF writes a file with nothing but an ELF header of the given type, which
+// is enough for it to be told apart as a shared object or as an executable
+func writeELF(t *testing.T, dir string, name string, fileType elf.Type) {
+	t.Helper()
+	header := elf.Header64{
+		Type:      uint16(fileType),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Ehsize:    uint16(binary.Size(elf.Header64{})),
+		Phentsize: uint16(binary.Size(elf.Prog64{})),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name), b.Bytes(), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeMachO writes a file with nothing but a Mach-O header of the given type,
+// which is what the plugins are built as on macOS
+func writeMachO(t *testing.T, dir string, name string, fileType macho.Type) {
+	t.Helper()
+	header := macho.FileHeader{
+		Magic: macho.Magic64,
+		Cpu:   macho.CpuArm64,
+		Type:  fileType,
+	}
+
+	var b bytes.Buffer
+	if err := binary.Write(&b, binary.LittleEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	// the reserved field of the 64-bit header
+	b.Write(make([]byte, 4))
+	if err := ioutil.WriteFile(path.Join(dir, name), b.Bytes(), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pluginConfig decodes the `config` of a plugin
+func pluginConfig(t *testing.T, plgCfg ConfigPlugin) map[string]interface{} {
+	t.Helper()
+	value := make(map[string]interface{})
+	if plgCfg.Config.Kind == 0 {
+		return value
+	}
+	if err := plgCfg.Config.Decode(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func pluginNames(cfg *Config) []string {
+	names := make([]string, 0, len(cfg.Plugins))
+	for _, plgCfg := range cfg.Plugins {
+		names = append(names, plgCfg.Name)
+	}
+	return names
+}
+
+func TestLoadConfigOverrideOrder(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+debug: false
+timeouts:
+  call: 1s
+  placeholder: "..."
+  stop: 5s
+`)
+	// merged in the order of their names rather than the order they were written in
+	writeFile(t, dir, "conf.d/90-personal.yaml", `
+debug: true
+timeouts:
+  call: 3s
+`)
+	writeFile(t, dir, "conf.d/10-team.yaml", `
+timeouts:
+  call: 2s
+  placeholder: "team"
+`)
+	// only the yaml files are merged
+	writeFile(t, dir, "conf.d/50-notes.txt", "debug: false\n")
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !cfg.Debug {
+		t.Errorf("expected debug to be set by the last file")
+	}
+	if cfg.Timeouts.Call != 3*time.Second {
+		t.Errorf("expected the call timeout of the last file, got %s", cfg.Timeouts.Call)
+	}
+	if cfg.Timeouts.Placeholder != "team" {
+		t.Errorf("expected the placeholder of the team file, got %q", cfg.Timeouts.Placeholder)
+	}
+	if cfg.Timeouts.Stop != 5*time.Second {
+		t.Errorf("expected the stop timeout of the configuration file to be kept, got %s", cfg.Timeouts.Stop)
+	}
+}
+
+func TestLoadConfigMergesPlugins(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+plugins:
+  - name: time
+  - name: bash
+    config:
+      commands:
+        date:
+          cmd: date
+          interval: 30
+        kubeContext:
+          cmd: kubectl config current-context
+          interval: 5
+      shells: [bash, zsh]
+`)
+	writeFile(t, dir, "conf.d/10-team.yaml", `
+plugins:
+  - name: bash
+    lazy: true
+    config:
+      commands:
+        kubeContext:
+          interval: 60
+      shells: [fish]
+  - name: network
+    config:
+      ipService: https://checkip.amazonaws.com/
+`)
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the plugins configured already keep their place
+	if names := pluginNames(cfg); !reflect.DeepEqual(names, []string{"time", "bash", "network"}) {
+		t.Fatalf("unexpected plugins %v", names)
+	}
+	if !cfg.Plugins[1].Lazy {
+		t.Errorf("expected the settings of the plugin to be merged")
+	}
+
+	expected := map[string]interface{}{
+		"commands": map[string]interface{}{
+			"date":        map[string]interface{}{"cmd": "date", "interval": 30},
+			"kubeContext": map[string]interface{}{"cmd": "kubectl config current-context", "interval": 60},
+		},
+		// lists are replaced rather than merged
+		"shells": []interface{}{"fish"},
+	}
+	if config := pluginConfig(t, cfg.Plugins[1]); !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected the configuration to be merged key by key, got %v", config)
+	}
+	if config := pluginConfig(t, cfg.Plugins[2]); config["ipService"] != "https://checkip.amazonaws.com/" {
+		t.Errorf("unexpected configuration for the added plugin %v", config)
+	}
+}
+
+func TestLoadConfigMergeErrors(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+plugins:
+  - name: bash
+    config: [date]
+`)
+	pluginFile := writeFile(t, dir, "bash.yaml", `
+commands:
+  date:
+    cmd: date
+`)
+
+	_, err := NewConfigFromFile(configFile)
+	expected := pluginFile + ": line 4: cannot merge a list into a map"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestLoadConfigPluginFile(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+plugins:
+  - name: finnhub
+    disabled: true
+    config:
+      tickers: [CFLT]
+  - name: vault
+`)
+	writeFile(t, dir, "finnhub.yaml", `
+token: ${env:GWL_TEST_UNSET}
+tickers: [AAPL, FB]
+refresh: 5m
+`)
+	writeFile(t, dir, "vault.yaml", "address: https://vault:8200\n")
+
+	// the references of the disabled plugin are not resolved
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if !cfg.Plugins[0].Disabled {
+		t.Errorf("expected the plugin to stay disabled")
+	}
+	expected := map[string]interface{}{
+		"token": "${env:GWL_TEST_UNSET}",
+		// the entry of the plugin wins over its file
+		"tickers": []interface{}{"CFLT"},
+		"refresh": "5m",
+	}
+	if config := pluginConfig(t, cfg.Plugins[0]); !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected the plugin file to be merged under the entry, got %v", config)
+	}
+	if config := pluginConfig(t, cfg.Plugins[1]); config["address"] != "https://vault:8200" {
+		t.Errorf("expected the configuration of the plugin file, got %v", config)
+	}
+}
+
+func TestAddDiscoveredPlugins(t *testing.T) {
+	dir := t.TempDir()
+	pluginsDir := path.Join(dir, "plugins")
+	if err := os.Mkdir(pluginsDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	writeELF(t, pluginsDir, "time", elf.ET_DYN)
+	writeELF(t, pluginsDir, "network.so", elf.ET_DYN)
+	writeELF(t, pluginsDir, "colourenv", elf.ET_DYN)
+	writeELF(t, pluginsDir, "finnhub-grpc", elf.ET_EXEC)
+	writeELF(t, pluginsDir, "bash", elf.ET_DYN)
+	writeMachO(t, pluginsDir, "vault", macho.TypeBundle)
+	writeMachO(t, pluginsDir, "vault-grpc", macho.TypeExec)
+	writeFile(t, pluginsDir, "README.md", "not a plugin\n")
+
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+discoverPlugins: true
+plugins:
+  - name: time
+  - name: commands
+    plugin: bash
+  - name: colourenv
+    disabled: true
+`)
+	writeFile(t, dir, "network.yaml", "ipService: https://checkip.amazonaws.com/\n")
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := cfg.AddDiscoveredPlugins(pluginsDir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the listed plugins are skipped, whether by name, by plugin file or disabled
+	if names := pluginNames(cfg); !reflect.DeepEqual(names, []string{"time", "commands", "colourenv", "network", "vault"}) {
+		t.Fatalf("unexpected plugins %v", names)
+	}
+
+	network := cfg.Plugins[3]
+	if network.PluginFile() != "network.so" || network.Disabled || network.Lazy {
+		t.Errorf("unexpected settings for the discovered plugin %+v", network)
+	}
+	if config := pluginConfig(t, network); config["ipService"] != "https://checkip.amazonaws.com/" {
+		t.Errorf("expected the configuration of the plugin file, got %v", config)
+	}
+
+	// discovering again does not add them twice
+	if err := cfg.AddDiscoveredPlugins(pluginsDir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cfg.Plugins) != 5 {
+		t.Fatalf("expected the discovered plugins to be added once, got %v", pluginNames(cfg))
+	}
+}
+
+func TestLoadConfigEmptyFiles(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", "")
+	writeFile(t, dir, "conf.d/10-empty.yaml", "# nothing yet\n")
+	writeFile(t, dir, "conf.d/20-plugins.yaml", "plugins:\n  - name: time\n")
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if names := pluginNames(cfg); !reflect.DeepEqual(names, []string{"time"}) {
+		t.Fatalf("unexpected plugins %v", names)
+	}
+
+	writeFile(t, dir, "conf.d/30-list.yaml", "- name: time\n")
+	if _, err := NewConfigFromFile(configFile); err == nil {
+		t.Fatal("expected a file that is not a map to be refused")
+	}
+}
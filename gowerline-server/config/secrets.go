@@ -0,0 +1,205 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
+	"gopkg.in/yaml.v3"
+)
+
+// secretCommandTimeout bounds the commands ran by `${cmd:...}` references
+const secretCommandTimeout = 10 * time.Second
+
+// referenceRegex matches the references to secrets that can be used in the
+// values of the configuration file:
+//
+//	${env:FINNHUB_TOKEN}          the value of an environment variable
+//	${file:~/.secrets/finnhub}    the content of a file
+//	${cmd:pass show finnhub}      the output of a command ran with `sh -c`
+//
+// The trailing newlines of files and command outputs are trimmed. A reference
+// is escaped by doubling its `$`, `$${env:-default}` is kept as `${env:-default}`
+// so that shell snippets can be written in the values.
+var referenceRegex = regexp.MustCompile(`\$?\$\{(env|file|cmd):([^}]+)\}`)
+
+// redactedMinLength is the length from which the secrets are removed from the errors
+// wherever they appear, the shorter ones only when yaml quotes them as a value
+const redactedMinLength = 4
+
+// redacted replaces the secrets in the errors
+const redacted = "<redacted>"
+
+// resolveDocument resolves the references of the configuration file, except
+// the ones of the disabled plugins which might not be resolvable on purpose
+func (l *loader) resolveDocument(root *yaml.Node) error {
+	if root.Kind != yaml.MappingNode {
+		return l.resolveReferences(root)
+	}
+
+	for idx := 0; idx+1 < len(root.Content); idx += 2 {
+		key, value := root.Content[idx], root.Content[idx+1]
+		if key.Value != "plugins" || value.Kind != yaml.SequenceNode {
+			if err := l.resolveReferences(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, plugin := range value.Content {
+			var entry struct {
+				Disabled bool `yaml:"disabled"`
+			}
+			// errors are reported when decoding the whole configuration
+			_ = plugin.Decode(&entry)
+			if entry.Disabled {
+				continue
+			}
+			if err := l.resolveReferences(plugin); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveReferences replaces the references to secrets in the scalar values of
+// the document. The errors only tell where the reference is and what it points
+// to, never what it resolved to, so that they can be logged safely. The secrets
+// are kept to remove them from the errors that might quote them later on.
+func (l *loader) resolveReferences(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+
+		var resolveErr error
+		resolved := false
+		value := referenceRegex.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			if resolveErr != nil {
+				return ""
+			}
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+			match := referenceRegex.FindStringSubmatch(reference)
+			secret, err := resolveReference(match[1], strings.TrimSpace(match[2]))
+			if err != nil {
+				resolveErr = fmt.Errorf("%s: line %d: could not resolve %s: %w", l.sources[node], node.Line, reference, err)
+			}
+			l.secrets = append(l.secrets, secret)
+			resolved = true
+			return secret
+		})
+		if resolveErr != nil {
+			return resolveErr
+		}
+
+		if value != node.Value {
+			if resolved {
+				l.secrets = append(l.secrets, value)
+			}
+			node.Value = value
+			// a secret is a string, whatever it looks like
+			node.Tag = "!!str"
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := l.resolveReferences(child); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		// only the values, keys are never secrets
+		for idx := 1; idx < len(node.Content); idx += 2 {
+			if err := l.resolveReferences(node.Content[idx]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// redact removes the secrets from an error, yaml quotes the values it cannot decode in
+// its errors, which are the whole value of a node that held references, cut after
+// seven characters when it is longer than ten
+func (l *loader) redact(err error) error {
+	if err == nil || len(l.secrets) == 0 {
+		return err
+	}
+
+	// the longest first, a secret may be part of a value
+	secrets := make([]string, len(l.secrets))
+	copy(secrets, l.secrets)
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+
+	message := err.Error()
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		if len(secret) > 10 {
+			message = strings.ReplaceAll(message, "`"+secret[:7]+"...`", "`"+redacted+"`")
+		}
+		message = strings.ReplaceAll(message, "`"+secret+"`", "`"+redacted+"`")
+		if len(secret) >= redactedMinLength {
+			message = strings.ReplaceAll(message, secret, redacted)
+		}
+	}
+
+	if message == err.Error() {
+		return err
+	}
+	return errors.New(message)
+}
+
+func resolveReference(kind string, target string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(target)
+		if !ok {
+			return "", fmt.Errorf("environment variable is not set")
+		}
+		return value, nil
+	case "file":
+		b, err := ioutil.ReadFile(paths.Expand(target))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	case "cmd":
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", target)
+		// the output of the command is the secret, its errors
+		// are not returned as they might contain it as well
+		cmd.Stderr = ioutil.Discard
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("command did not complete within %s", secretCommandTimeout)
+			}
+			return "", fmt.Errorf("command failed: %w", err)
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+
+	return "", fmt.Errorf("unknown reference type %s", kind)
+}
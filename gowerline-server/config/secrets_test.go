@@ -0,0 +1,291 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeFile writes a file of the test directory and returns its path
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	file := path.Join(dir, name)
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestResolveReferences(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GWL_TEST_TOKEN", "env-token")
+	t.Setenv("GWL_TEST_EMPTY", "")
+	tokenFile := writeFile(t, dir, "token", "file-token\n\n")
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+		// err is the error expected, none when empty
+		err string
+	}{
+		{
+			name:  "no reference",
+			value: "token",
+			want:  "token",
+		},
+		{
+			name:  "environment variable",
+			value: "${env:GWL_TEST_TOKEN}",
+			want:  "env-token",
+		},
+		{
+			name:  "empty environment variable",
+			value: "${env:GWL_TEST_EMPTY}",
+			want:  "",
+		},
+		{
+			name:  "file",
+			value: "${file:" + tokenFile + "}",
+			want:  "file-token",
+		},
+		{
+			name:  "command",
+			value: "${cmd:printf 'cmd-token\\n'}",
+			want:  "cmd-token",
+		},
+		{
+			name:  "partial interpolation",
+			value: "Bearer ${env:GWL_TEST_TOKEN}",
+			want:  "Bearer env-token",
+		},
+		{
+			name:  "several references",
+			value: "${env:GWL_TEST_TOKEN}:${cmd:echo cmd-token}",
+			want:  "env-token:cmd-token",
+		},
+		{
+			name:  "escaped reference",
+			value: "echo $${env:-default}",
+			want:  "echo ${env:-default}",
+		},
+		{
+			name:  "escaped and resolved references",
+			value: "$${cmd:date}:${env:GWL_TEST_TOKEN}",
+			want:  "${cmd:date}:env-token",
+		},
+		{
+			name:  "unset environment variable",
+			value: "${env:GWL_TEST_UNSET}",
+			err:   "gowerline.yaml: line 3: could not resolve ${env:GWL_TEST_UNSET}: environment variable is not set",
+		},
+		{
+			name:  "missing file",
+			value: "${file:" + path.Join(dir, "missing") + "}",
+			err:   "gowerline.yaml: line 3: could not resolve ${file:" + path.Join(dir, "missing") + "}: open " + path.Join(dir, "missing") + ": no such file or directory",
+		},
+		{
+			name:  "failed command",
+			value: "${cmd:printf 's3%s' cr3t; printf 's3%s' cr3t >&2; exit 3}",
+			err:   "gowerline.yaml: line 3: could not resolve ${cmd:printf 's3%s' cr3t; printf 's3%s' cr3t >&2; exit 3}: command failed: exit status 3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: test.value, Line: 3}
+			l := &loader{sources: map[*yaml.Node]string{node: "gowerline.yaml"}}
+
+			err := l.resolveReferences(node)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if node.Value != test.want {
+				t.Fatalf("expected %q, got %q", test.want, node.Value)
+			}
+			// the secrets are strings, whatever they look like
+			if test.value != test.want && node.Tag != "!!str" {
+				t.Fatalf("expected a string, got %s", node.Tag)
+			}
+		})
+	}
+}
+
+func TestResolveSkipsDisabledPlugins(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GWL_TEST_TOKEN", "env-token")
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+plugins:
+  - name: finnhub
+    config:
+      token: ${env:GWL_TEST_TOKEN}
+  - name: vault
+    disabled: true
+    config:
+      token: ${env:GWL_TEST_UNSET}
+`)
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tokens := make(map[string]string)
+	for _, plgCfg := range cfg.Plugins {
+		var pluginConfig struct {
+			Token string `yaml:"token"`
+		}
+		if err := plgCfg.Config.Decode(&pluginConfig); err != nil {
+			t.Fatal(err)
+		}
+		tokens[plgCfg.Name] = pluginConfig.Token
+	}
+	if tokens["finnhub"] != "env-token" {
+		t.Errorf("expected the reference of finnhub to be resolved, got %q", tokens["finnhub"])
+	}
+	if tokens["vault"] != "${env:GWL_TEST_UNSET}" {
+		t.Errorf("expected the reference of the disabled plugin to be left as is, got %q", tokens["vault"])
+	}
+
+	// they are all left as is when the references are not resolved
+	cfg, err = NewUnresolvedConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.Plugins[0].Config.Content[1].Value != "${env:GWL_TEST_TOKEN}" {
+		t.Errorf("expected the reference to be left as is, got %q", cfg.Plugins[0].Config.Content[1].Value)
+	}
+}
+
+func TestResolveErrorsNameTheReference(t *testing.T) {
+	dir := t.TempDir()
+	configFile := writeFile(t, dir, "gowerline.yaml", `
+plugins:
+  - name: finnhub
+    config:
+      token: ${env:GWL_TEST_UNSET}
+`)
+
+	_, err := NewConfigFromFile(configFile)
+	expected := configFile + ": line 5: could not resolve ${env:GWL_TEST_UNSET}: environment variable is not set"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestSecretsAreRedacted(t *testing.T) {
+	t.Setenv("GWL_TEST_LONG", "long-s3cr3t-value")
+	t.Setenv("GWL_TEST_SHORT", "s3cr")
+	t.Setenv("GWL_TEST_TINY", "abc")
+
+	tests := []struct {
+		name   string
+		config string
+		// secret must not be part of the errors
+		secret string
+	}{
+		{
+			name:   "long secret in a duration",
+			config: "timeouts:\n  call: ${env:GWL_TEST_LONG}\n",
+			secret: "long-s3",
+		},
+		{
+			name:   "short secret in a duration",
+			config: "timeouts:\n  call: ${env:GWL_TEST_SHORT}\n",
+			secret: "s3cr",
+		},
+		{
+			name:   "tiny secret in a boolean",
+			config: "debug: ${env:GWL_TEST_TINY}\n",
+			secret: "`abc`",
+		},
+		{
+			name:   "partial interpolation in a duration",
+			config: "timeouts:\n  stop: 1${env:GWL_TEST_SHORT}\n",
+			secret: "s3cr",
+		},
+		{
+			name:   "secret in a plugin timeout",
+			config: "plugins:\n  - name: finnhub\n    timeouts:\n      functions:\n        ticker: ${env:GWL_TEST_LONG}\n",
+			secret: "long-s3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configFile := writeFile(t, t.TempDir(), "gowerline.yaml", test.config)
+
+			_, err := NewConfigFromFile(configFile)
+			if err == nil {
+				t.Fatal("expected the configuration to be refused")
+			}
+			if strings.Contains(err.Error(), test.secret) {
+				t.Fatalf("the error quotes the secret: %s", err)
+			}
+			if !strings.Contains(err.Error(), redacted) {
+				t.Fatalf("expected the secret to be redacted: %s", err)
+			}
+		})
+	}
+}
+
+func TestPluginErrorsAreRedacted(t *testing.T) {
+	t.Setenv("GWL_TEST_LONG", "long-s3cr3t-value")
+	configFile := writeFile(t, t.TempDir(), "gowerline.yaml", `
+plugins:
+  - name: network
+    config:
+      # a plugin without a schema decoding its configuration
+      port: ${env:GWL_TEST_LONG}
+      token: Bearer ${env:GWL_TEST_LONG}
+`)
+
+	cfg, err := NewConfigFromFile(configFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var pluginConfig struct {
+		Port    int           `yaml:"port"`
+		Refresh time.Duration `yaml:"token"`
+	}
+	err = cfg.Plugins[0].Config.Decode(&pluginConfig)
+	if err == nil {
+		t.Fatal("expected the configuration of the plugin to be refused")
+	}
+	if !strings.Contains(err.Error(), "long-s3") || !strings.Contains(err.Error(), "Bearer ") {
+		t.Fatalf("expected yaml to quote the values: %s", err)
+	}
+
+	for _, err := range []error{
+		err,
+		errors.New("invalid token long-s3cr3t-value"),
+		errors.New("invalid header Bearer long-s3cr3t-value"),
+	} {
+		redactedErr := cfg.Redact(err)
+		if strings.Contains(redactedErr.Error(), "long-s3") || strings.Contains(redactedErr.Error(), "Bearer l") {
+			t.Errorf("the error quotes the secret: %s", redactedErr)
+		}
+	}
+
+	// the errors without secrets are left untouched
+	err = errors.New("could not connect")
+	if cfg.Redact(err) != err {
+		t.Errorf("expected the error to be left untouched")
+	}
+}
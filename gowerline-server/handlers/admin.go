@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+func BuildReloadHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		err := mgr.Reload(ctx)
+		if err != nil {
+			log.Error("could not reload configuration", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+	}
+}
+
+// BuildPluginAdminHandler builds the handler enabling, disabling or restarting the plugin of the
+// route, the `persist` query parameter keeps the plugin enabled or disabled across restarts
+func BuildPluginAdminHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager, action string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		persist, _ := strconv.ParseBool(c.Query("persist"))
+
+		var err error
+		var status string
+		switch action {
+		case "enable":
+			err = mgr.Enable(ctx, name, persist)
+			status = "enabled"
+		case "disable":
+			err = mgr.Disable(ctx, name, persist)
+			status = "disabled"
+		case "restart":
+			err = mgr.Restart(ctx, name)
+			status = "restarted"
+		}
+
+		if errors.Is(err, manager.ErrNoSuchPlugin) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, manager.ErrPluginDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, manager.ErrReleased) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			log.Error("could not "+action+" plugin", zap.String("plugin", name), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": status})
+	}
+}
+
+func BuildLogLevelsHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, mgr.LogLevels())
+	}
+}
+
+// BuildSetLogLevelHandler builds the handler changing the level of the logs of
+// the server or of a plugin, it answers with the levels once changed
+func BuildSetLogLevelHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var request types.LogLevelRequest
+		requestBytes, err := ioutil.ReadAll(c.Request.Body)
+		if err == nil {
+			err = json.Unmarshal(requestBytes, &request)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = mgr.SetLogLevel(ctx, request.Plugin, request.Level)
+		if errors.Is(err, manager.ErrInvalidLogLevel) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, manager.ErrNoSuchPlugin) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		} else if errors.Is(err, manager.ErrPluginDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, mgr.LogLevels())
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+// BuildBatchHandler renders several segments in a single request, the
+// calls are ran concurrently and the results returned in order
+func BuildBatchHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var request types.BatchRequest
+
+		requestBytes, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			log.Error(
+				"could not read request",
+				zap.Error(err),
+			)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("err: %s", err)})
+			return
+		}
+
+		err = json.Unmarshal(requestBytes, &request)
+		if err != nil {
+			log.Error(
+				"could not unmarshal request",
+				zap.Error(err),
+			)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("err: %s", err)})
+			return
+		}
+
+		results := make([]types.BatchResult, len(request.Payloads))
+		wg := &sync.WaitGroup{}
+		for idx := range request.Payloads {
+			payload := request.Payload(idx)
+			result := &results[idx]
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result.Function = payload.Function
+				var err error
+				result.Status, result.Segments, err = callPlugin(c.Request.Context(), log, mgr, payload)
+				if err != nil {
+					result.Error = err.Error()
+				}
+			}()
+		}
+		wg.Wait()
+
+		c.JSON(http.StatusOK, results)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// loopbackHosts are the only host names the TCP listener answers to, anything
+// else is a page of some other site that got its name resolved to the loopback
+var loopbackHosts = map[string]bool{
+	"localhost": true,
+	"127.0.0.1": true,
+	"::1":       true,
+}
+
+// BuildTCPGuard protects the requests made over TCP, which any local process or web
+// page can make, unlike the ones made over the unix socket:
+//   - the Host must be the loopback address the server listens on, which
+//     defeats DNS rebinding
+//   - requests made by web pages, which carry an Origin, are refused
+//   - the bearer token is required when one is set
+func BuildTCPGuard(log *zap.Logger, token string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		localAddr, ok := c.Request.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		if !ok {
+			c.Next()
+			return
+		}
+		port := strconv.Itoa(localAddr.Port)
+
+		if !isLoopbackHost(c.Request.Host, port) {
+			log.Warn("refused request with an unexpected host", zap.String("host", c.Request.Host))
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "unexpected host"})
+			return
+		}
+
+		if origin := c.Request.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme != "http" || !isLoopbackHost(u.Host, port) {
+				log.Warn("refused cross origin request", zap.String("origin", origin))
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "cross origin requests are not allowed"})
+				return
+			}
+		}
+
+		if token != "" {
+			authorization := c.Request.Header.Get("Authorization")
+			provided := strings.TrimPrefix(authorization, "Bearer ")
+			if provided == authorization || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// isLoopbackHost tells whether host is a loopback name with the given port
+func isLoopbackHost(host string, port string) bool {
+	hostname, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		// no port, which is what clients do for the default one
+		hostname, hostPort = strings.Trim(host, "[]"), "80"
+	}
+	return loopbackHosts[hostname] && hostPort == port
+}
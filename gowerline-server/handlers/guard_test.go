@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// guardedRequest makes a request to a router protected by the guard, as if it
+// was accepted on the given local address the way the listeners set it
+func guardedRequest(t *testing.T, token string, localAddr net.Addr, host string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(BuildTCPGuard(zap.NewNop(), token))
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+	req.Host = host
+	for header, value := range headers {
+		req.Header.Set(header, value)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestTCPGuard(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6666}
+	unixAddr := &net.UnixAddr{Name: "/run/user/1000/gowerline/gowerline.sock", Net: "unix"}
+
+	tests := []struct {
+		name      string
+		token     string
+		localAddr net.Addr
+		host      string
+		headers   map[string]string
+		status    int
+	}{
+		{
+			name:      "loopback host",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "localhost",
+			localAddr: tcpAddr,
+			host:      "localhost:6666",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "ipv6 loopback",
+			localAddr: &net.TCPAddr{IP: net.IPv6loopback, Port: 6666},
+			host:      "[::1]:6666",
+			status:    http.StatusOK,
+		},
+		{
+			name:      "rebinding host",
+			localAddr: tcpAddr,
+			host:      "attacker.example.com:6666",
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "loopback host on another port",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:8080",
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "loopback host without a port",
+			localAddr: tcpAddr,
+			host:      "localhost",
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "same origin",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Origin": "http://127.0.0.1:6666"},
+			status:    http.StatusOK,
+		},
+		{
+			name:      "foreign origin",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Origin": "https://attacker.example.com"},
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "null origin",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Origin": "null"},
+			status:    http.StatusForbidden,
+		},
+		{
+			name:      "valid token",
+			token:     "s3cr3t",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Authorization": "Bearer s3cr3t"},
+			status:    http.StatusOK,
+		},
+		{
+			name:      "missing token",
+			token:     "s3cr3t",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			status:    http.StatusUnauthorized,
+		},
+		{
+			name:      "wrong token",
+			token:     "s3cr3t",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Authorization": "Bearer s3cr3"},
+			status:    http.StatusUnauthorized,
+		},
+		{
+			name:      "token without the bearer scheme",
+			token:     "s3cr3t",
+			localAddr: tcpAddr,
+			host:      "127.0.0.1:6666",
+			headers:   map[string]string{"Authorization": "s3cr3t"},
+			status:    http.StatusUnauthorized,
+		},
+		{
+			name:      "unix socket",
+			token:     "s3cr3t",
+			localAddr: unixAddr,
+			host:      "attacker.example.com",
+			headers:   map[string]string{"Origin": "https://attacker.example.com"},
+			status:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := guardedRequest(t, test.token, test.localAddr, test.host, test.headers)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+			if test.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("expected the token to be asked for")
+			}
+		})
+	}
+}
+
+func TestTCPGuardOverTCP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(BuildTCPGuard(zap.NewNop(), "s3cr3t"))
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	for _, test := range []struct {
+		name   string
+		host   string
+		token  string
+		status int
+	}{
+		{name: "valid request", token: "s3cr3t", status: http.StatusOK},
+		{name: "rebinding host", host: "attacker.example.com", token: "s3cr3t", status: http.StatusForbidden},
+		{name: "missing token", status: http.StatusUnauthorized},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/ping", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.host != "" {
+				req.Host = test.host
+			}
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -3,17 +3,26 @@ package handlers
 import (
 	"context"
 
-	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
 	"go.uber.org/zap"
 
 	"github.com/gin-gonic/gin"
 )
 
-func SetupHandlers(router *gin.Engine, ctx context.Context, log *zap.Logger, plugins map[string]*plugins.Plugin) error {
+func SetupHandlers(router *gin.Engine, ctx context.Context, log *zap.Logger, mgr *manager.Manager) error {
 	router.GET("/ping", PingHandler)
-	router.POST("/plugin", BuildPluginHandler(ctx, log, plugins))
-	router.GET("/plugins", BuildPluginStatusHandler(ctx, log, plugins))
+	router.POST("/plugin", BuildPluginHandler(ctx, log, mgr))
+	router.GET("/plugins", BuildPluginStatusHandler(ctx, log, mgr))
+	router.GET("/plugins/:name", BuildSinglePluginStatusHandler(ctx, log, mgr))
+	router.POST("/plugins/batch", BuildBatchHandler(ctx, log, mgr))
 	router.GET("/version", versionHandler)
+	router.GET("/metrics", BuildMetricsHandler(ctx, log, mgr))
+	router.POST("/admin/reload", BuildReloadHandler(ctx, log, mgr))
+	router.POST("/admin/plugins/:name/enable", BuildPluginAdminHandler(ctx, log, mgr, "enable"))
+	router.POST("/admin/plugins/:name/disable", BuildPluginAdminHandler(ctx, log, mgr, "disable"))
+	router.POST("/admin/plugins/:name/restart", BuildPluginAdminHandler(ctx, log, mgr, "restart"))
+	router.GET("/admin/loglevel", BuildLogLevelsHandler(ctx, log, mgr))
+	router.POST("/admin/loglevel", BuildSetLogLevelHandler(ctx, log, mgr))
 
 	return nil
 }
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
+	"go.uber.org/zap"
+)
+
+func BuildMetricsHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	// a plugin failing to report its metrics should not hide the others
+	handler := promhttp.HandlerFor(mgr.Gatherer(), promhttp.HandlerOpts{
+		ErrorLog:      zap.NewStdLog(log),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+
+	return gin.WrapH(handler)
+}
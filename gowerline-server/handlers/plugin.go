@@ -3,17 +3,18 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
 	"go.uber.org/zap"
 )
 
-func BuildPluginHandler(ctx context.Context, log *zap.Logger, pluginMap map[string]*plugins.Plugin) func(c *gin.Context) {
+func BuildPluginHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		var payload types.Payload
 
@@ -41,33 +42,48 @@ func BuildPluginHandler(ctx context.Context, log *zap.Logger, pluginMap map[stri
 			return
 		}
 
-		plg, ok := pluginMap[payload.Function]
-		if !ok {
-			c.JSON(http.StatusNotFound, []types.PowerlineReturn{
-				{Content: fmt.Sprintf("no such function %s", payload.Function)},
-			})
-			return
-		}
-
-		result, err := plg.RunCall(
-			context.Background(),
-			log.With(zap.String("function", payload.Function)),
-			&payload)
-		if err != nil {
-			log.Error(
-				"could not unmarshal request",
-				zap.Error(err),
-			)
-			c.JSON(http.StatusInternalServerError, []types.PowerlineReturn{
-				{Content: fmt.Sprintf("err:%s %s", payload.Function, err)},
-			})
-			return
-		}
+		status, result, _ := callPlugin(c.Request.Context(), log, mgr, &payload)
+		c.JSON(status, result)
+	}
+}
 
-		if result == nil {
-			result = make([]*types.PowerlineReturn, 0)
-		}
+// callPlugin runs a function call and returns the HTTP status and
+// the segments to render, which describe the error if any
+func callPlugin(ctx context.Context, log *zap.Logger, mgr *manager.Manager, payload *types.Payload) (int, []*types.PowerlineReturn, error) {
+	result, err := mgr.Call(
+		ctx,
+		log.With(zap.String("function", payload.Function)),
+		payload)
+	if errors.Is(err, manager.ErrNoSuchFunction) {
+		return http.StatusNotFound, []*types.PowerlineReturn{
+			{Content: fmt.Sprintf("no such function %s", payload.Function)},
+		}, err
+	} else if errors.Is(err, manager.ErrAmbiguousFunction) {
+		return http.StatusNotFound, []*types.PowerlineReturn{
+			{Content: err.Error()},
+		}, err
+	} else if errors.Is(err, manager.ErrInvalidArguments) {
+		return http.StatusBadRequest, []*types.PowerlineReturn{
+			{Content: err.Error()},
+		}, err
+	} else if errors.Is(err, manager.ErrCircuitOpen) {
+		return http.StatusServiceUnavailable, []*types.PowerlineReturn{
+			{Content: fmt.Sprintf("err:%s %s", payload.Function, err)},
+		}, err
+	} else if err != nil {
+		log.Error(
+			"plugin call failed",
+			zap.String("function", payload.Function),
+			zap.Error(err),
+		)
+		return http.StatusInternalServerError, []*types.PowerlineReturn{
+			{Content: fmt.Sprintf("err:%s %s", payload.Function, err)},
+		}, err
+	}
 
-		c.JSON(http.StatusOK, result)
+	if result == nil {
+		result = make([]*types.PowerlineReturn, 0)
 	}
+
+	return http.StatusOK, result, nil
 }
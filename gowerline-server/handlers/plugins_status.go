@@ -5,17 +5,24 @@ import (
 	"net/http"
 
 	"github.com/gin-gonic/gin"
-	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
-	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/manager"
 	"go.uber.org/zap"
 )
 
-func BuildPluginStatusHandler(ctx context.Context, log *zap.Logger, pluginMap map[string]*plugins.Plugin) func(c *gin.Context) {
+func BuildPluginStatusHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		result := make(map[string]types.PluginMetadata)
-		for _, plg := range pluginMap {
-			result[plg.Name] = plg.Metadata
+		c.JSON(http.StatusOK, mgr.Status(c.Request.Context()))
+	}
+}
+
+func BuildSinglePluginStatusHandler(ctx context.Context, log *zap.Logger, mgr *manager.Manager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		status, ok := mgr.PluginStatus(c.Request.Context(), name)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no such plugin " + name})
+			return
 		}
-		c.JSON(http.StatusOK, result)
+		c.JSON(http.StatusOK, status)
 	}
 }
@@ -0,0 +1,236 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// disabledPluginsFileName holds the plugins that stay disabled across
+// restarts of the server, in the state directory
+const disabledPluginsFileName = "disabled-plugins.yaml"
+
+var (
+	// ErrNoSuchPlugin is returned for the plugins that are not in the configuration
+	ErrNoSuchPlugin = errors.New("no such plugin")
+	// ErrPluginDisabled is returned for the plugins disabled in the
+	// configuration, and when restarting a plugin disabled at runtime
+	ErrPluginDisabled = errors.New("plugin is disabled")
+	// ErrReleased is returned when the plugins are being started by the server
+	// replacing this one, which is the one to manage them from then on
+	ErrReleased = errors.New("the plugins were released for the new server")
+)
+
+// Disable stops a plugin and unregisters its functions until it is enabled again,
+// the other plugins are left untouched. When persist is set it stays disabled when
+// the server restarts.
+func (m *Manager) Disable(ctx context.Context, name string, persist bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.released {
+		return ErrReleased
+	}
+	if _, err := m.configuredPlugin(name); err != nil {
+		return err
+	}
+
+	if persist && !m.persisted[name] {
+		m.persisted[name] = true
+		if err := m.saveDisabledPlugins(); err != nil {
+			delete(m.persisted, name)
+			return err
+		}
+	}
+
+	if m.disabled[name] {
+		return nil
+	}
+	m.log.Info("disabling plugin", zap.String("plugin", name), zap.Bool("persist", persist))
+	m.disabled[name] = true
+
+	// a plugin still starting notices it is no longer wanted when it is done
+	delete(m.pending, name)
+	instance, running := m.instances[name]
+	delete(m.instances, name)
+	m.setDisabledStats(name)
+	m.swap()
+
+	if running {
+		return m.stopInstance(ctx, instance)
+	}
+	return nil
+}
+
+// Enable starts a plugin disabled at runtime again and waits for it, unless it is lazy.
+// When persist is set it is no longer disabled when the server restarts either.
+func (m *Manager) Enable(ctx context.Context, name string, persist bool) error {
+	m.mutex.Lock()
+
+	if m.released {
+		m.mutex.Unlock()
+		return ErrReleased
+	}
+	plgCfg, err := m.configuredPlugin(name)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+
+	if persist && m.persisted[name] {
+		delete(m.persisted, name)
+		if err := m.saveDisabledPlugins(); err != nil {
+			m.persisted[name] = true
+			m.mutex.Unlock()
+			return err
+		}
+	}
+
+	if !m.disabled[name] {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.log.Info("enabling plugin", zap.String("plugin", name), zap.Bool("persist", persist))
+	delete(m.disabled, name)
+
+	return m.startPlugin(ctx, name, plgCfg)
+}
+
+// Restart stops a plugin and starts it again, which initialises it from scratch, and waits
+// for it unless it is lazy. The functions of the other plugins are left untouched.
+func (m *Manager) Restart(ctx context.Context, name string) error {
+	m.mutex.Lock()
+
+	if m.released {
+		m.mutex.Unlock()
+		return ErrReleased
+	}
+	plgCfg, err := m.configuredPlugin(name)
+	if err != nil {
+		m.mutex.Unlock()
+		return err
+	}
+	if m.disabled[name] {
+		m.mutex.Unlock()
+		return fmt.Errorf("%w, enable it instead: %s", ErrPluginDisabled, name)
+	}
+
+	m.log.Info("restarting plugin", zap.String("plugin", name))
+	instance, running := m.instances[name]
+	delete(m.instances, name)
+	if running {
+		// hide it before actually stopping it
+		m.swap()
+		// the new instance opens the same storage
+		if err := m.stopInstance(ctx, instance); err != nil {
+			m.log.Warn("restarting the plugin anyway", zap.String("plugin", name))
+		}
+	}
+
+	return m.startPlugin(ctx, name, plgCfg)
+}
+
+// startPlugin registers a plugin as pending and starts it unless it is lazy, it must
+// be called with the mutex held and releases it
+func (m *Manager) startPlugin(ctx context.Context, name string, plgCfg config.ConfigPlugin) error {
+	rawConfig, err := serialiseConfig(plgCfg)
+	if err != nil {
+		m.swap()
+		m.mutex.Unlock()
+		return fmt.Errorf("invalid configuration for plugin %s: %w", name, err)
+	}
+
+	pending := m.newPending(name, plgCfg, rawConfig)
+	m.swap()
+	m.mutex.Unlock()
+
+	if !pending.started {
+		return nil
+	}
+	return m.runStart(ctx, name, pending)
+}
+
+// configuredPlugin returns the configuration of a plugin that is not disabled
+// in the configuration, it must be called with the mutex held
+func (m *Manager) configuredPlugin(name string) (config.ConfigPlugin, error) {
+	for _, plgCfg := range m.cfg.Plugins {
+		if plgCfg.Name != name {
+			continue
+		}
+		if plgCfg.Disabled {
+			return plgCfg, fmt.Errorf("%w in the configuration: %s", ErrPluginDisabled, name)
+		}
+		return plgCfg, nil
+	}
+
+	return config.ConfigPlugin{}, fmt.Errorf("%w %s", ErrNoSuchPlugin, name)
+}
+
+// setDisabledStats reports a plugin as disabled, the stats it already
+// has are kept when it is. It must be called with the mutex held.
+func (m *Manager) setDisabledStats(name string) {
+	m.statsMutex.Lock()
+	stats, ok := m.stats[name]
+	m.statsMutex.Unlock()
+	if ok && stats.status().State == types.PluginStateDisabled {
+		return
+	}
+
+	stats = newPluginStats()
+	stats.SetState(types.PluginStateDisabled)
+	m.setStats(name, stats)
+}
+
+// disabledPluginsFile returns the path of the file holding the plugins
+// that stay disabled across restarts
+func disabledPluginsFile() string {
+	return path.Join(paths.StateDir(), disabledPluginsFileName)
+}
+
+// loadDisabledPlugins returns the plugins that stay disabled across restarts
+func loadDisabledPlugins() ([]string, error) {
+	b, err := ioutil.ReadFile(disabledPluginsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if err := yaml.Unmarshal(b, &names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// saveDisabledPlugins writes the plugins that stay disabled across
+// restarts, it must be called with the mutex held
+func (m *Manager) saveDisabledPlugins() error {
+	names := make([]string, 0, len(m.persisted))
+	for name := range m.persisted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b, err := yaml.Marshal(names)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(paths.StateDir(), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(disabledPluginsFile(), b, 0600); err != nil {
+		return fmt.Errorf("could not save the disabled plugins: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"context"
+	"time"
+)
+
+// runBounded runs fn with a context that expires after the timeout, and waits for
+// it until then. Plugins are free to ignore the context, so we do not wait on them
+// past the deadline regardless: fn is left running in the background, and the
+// error of the context is returned with returned set to false. abandoned, if set,
+// is called once such a fn eventually returns, so that what it left behind can be
+// cleaned up. fn must not be relied on to have returned when returned is false.
+func runBounded(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error, abandoned func()) (returned bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	done := make(chan error, 1)
+	go func() {
+		defer cancel()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-ctx.Done():
+		if abandoned != nil {
+			go func() {
+				<-done
+				abandoned()
+			}()
+		}
+		return false, ctx.Err()
+	}
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+// breaker counts the consecutive failures of a plugin. Once there are too many of
+// them it opens and calls are short-circuited until the cooldown expires, after
+// which it is half-open: a single call goes through as a probe, and decides if it
+// closes or opens again. The other calls are short-circuited until then.
+type breaker struct {
+	mutex     *sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	// probing is set while the probe of the half-open breaker is in flight
+	probing bool
+}
+
+func newBreaker() *breaker {
+	return &breaker{
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Allow tells whether a call can go through, the call let through a half-open
+// breaker must report its outcome with Success, Failure or Abort
+func (b *breaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.open {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *breaker) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.probing = false
+}
+
+// Abort tells that a call ended without telling anything about the
+// plugin, a half-open breaker lets another call through as its probe
+func (b *breaker) Abort() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+// Failure records a failed call, and returns true if it opened the breaker
+func (b *breaker) Failure(settings config.ConfigBreaker) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failures++
+	// a failure while half-open opens it right away
+	if b.failures >= settings.Failures || b.open {
+		b.open = true
+		b.openUntil = time.Now().Add(settings.Cooldown)
+		b.probing = false
+		return true
+	}
+
+	return false
+}
+
+func (b *breaker) Status() types.BreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	status := types.BreakerStatus{
+		State:               types.BreakerStateClosed,
+		ConsecutiveFailures: b.failures,
+	}
+
+	if b.open {
+		if time.Now().After(b.openUntil) {
+			status.State = types.BreakerStateHalfOpen
+		} else {
+			openUntil := b.openUntil
+			status.State = types.BreakerStateOpen
+			status.OpenUntil = &openUntil
+		}
+	}
+
+	return status
+}
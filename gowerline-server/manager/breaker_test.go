@@ -0,0 +1,134 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+// breakerStep is an operation on a breaker, along with what it is expected to
+// return and the state the breaker is expected to be in afterwards
+type breakerStep struct {
+	op    string
+	want  bool
+	state string
+}
+
+func TestBreaker(t *testing.T) {
+	settings := config.ConfigBreaker{Failures: 2, Cooldown: time.Hour}
+
+	tests := []struct {
+		name  string
+		steps []breakerStep
+	}{
+		{
+			name: "closed",
+			steps: []breakerStep{
+				{op: "allow", want: true, state: types.BreakerStateClosed},
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "success", state: types.BreakerStateClosed},
+				// the failures must be consecutive
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "allow", want: true, state: types.BreakerStateClosed},
+			},
+		},
+		{
+			name: "opens after consecutive failures",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "allow", want: false, state: types.BreakerStateOpen},
+			},
+		},
+		{
+			name: "single probe once half-open",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "expire", state: types.BreakerStateHalfOpen},
+				{op: "allow", want: true, state: types.BreakerStateHalfOpen},
+				// the other calls wait for the probe
+				{op: "allow", want: false, state: types.BreakerStateHalfOpen},
+				{op: "allow", want: false, state: types.BreakerStateHalfOpen},
+			},
+		},
+		{
+			name: "successful probe closes it",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "expire", state: types.BreakerStateHalfOpen},
+				{op: "allow", want: true, state: types.BreakerStateHalfOpen},
+				{op: "success", state: types.BreakerStateClosed},
+				{op: "allow", want: true, state: types.BreakerStateClosed},
+				{op: "allow", want: true, state: types.BreakerStateClosed},
+			},
+		},
+		{
+			name: "failed probe opens it again",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "expire", state: types.BreakerStateHalfOpen},
+				{op: "allow", want: true, state: types.BreakerStateHalfOpen},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "allow", want: false, state: types.BreakerStateOpen},
+			},
+		},
+		{
+			name: "aborted probe lets another call through",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+				{op: "expire", state: types.BreakerStateHalfOpen},
+				{op: "allow", want: true, state: types.BreakerStateHalfOpen},
+				{op: "abort", state: types.BreakerStateHalfOpen},
+				{op: "allow", want: true, state: types.BreakerStateHalfOpen},
+				{op: "allow", want: false, state: types.BreakerStateHalfOpen},
+			},
+		},
+		{
+			name: "abort while closed",
+			steps: []breakerStep{
+				{op: "failure", want: false, state: types.BreakerStateClosed},
+				{op: "abort", state: types.BreakerStateClosed},
+				// an aborted call is not a success either
+				{op: "failure", want: true, state: types.BreakerStateOpen},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBreaker()
+			for idx, step := range test.steps {
+				var got bool
+				switch step.op {
+				case "allow":
+					got = b.Allow()
+				case "failure":
+					got = b.Failure(settings)
+				case "success":
+					b.Success()
+				case "abort":
+					b.Abort()
+				case "expire":
+					b.mutex.Lock()
+					b.openUntil = time.Now().Add(-time.Second)
+					b.mutex.Unlock()
+				default:
+					t.Fatalf("unknown operation %s", step.op)
+				}
+
+				if got != step.want {
+					t.Fatalf("step %d: expected %s to return %t, got %t", idx, step.op, step.want, got)
+				}
+				if state := b.Status().State; state != step.state {
+					t.Fatalf("step %d: expected the breaker to be %s after %s, got %s", idx, step.state, step.op, state)
+				}
+			}
+		})
+	}
+}
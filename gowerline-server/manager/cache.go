@@ -0,0 +1,157 @@
+package manager
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+const (
+	// cacheMaxEntries bounds the number of results kept in the cache
+	cacheMaxEntries = 4096
+	// cacheMaxStaleness is how long past its TTL a result can still be served
+	cacheMaxStaleness = 10 * time.Minute
+)
+
+type cacheEntry struct {
+	instance string
+	result   []*types.PowerlineReturn
+	expires  time.Time
+}
+
+// responseCache holds the results of the functions that declare a TTL. Expired
+// entries are kept around so they can be served while a refresh is in flight.
+type responseCache struct {
+	mutex      *sync.Mutex
+	entries    map[string]*cacheEntry
+	refreshing map[string]struct{}
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{
+		mutex:      &sync.Mutex{},
+		entries:    make(map[string]*cacheEntry),
+		refreshing: make(map[string]struct{}),
+	}
+}
+
+// cacheKey identifies a call, only the environment variables and working
+// directory the function declares it depends on are taken into account
+func cacheKey(fn *function, payload *types.Payload) string {
+	var b strings.Builder
+	b.WriteString(fn.instance)
+	b.WriteByte(0)
+	b.WriteString(fn.name)
+	b.WriteByte(0)
+	if payload.Args != nil {
+		b.Write(*payload.Args)
+	}
+
+	env := make([]string, len(fn.cache.Env))
+	copy(env, fn.cache.Env)
+	sort.Strings(env)
+	for _, name := range env {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(payload.Env[name])
+	}
+
+	if fn.cache.Cwd {
+		b.WriteByte(0)
+		b.WriteString(payload.Cwd)
+	}
+
+	return b.String()
+}
+
+// Get returns the cached result for a key, and whether it is still fresh
+func (c *responseCache) Get(key string) (result []*types.PowerlineReturn, fresh bool, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+
+	now := time.Now()
+	if now.After(entry.expires.Add(cacheMaxStaleness)) {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+
+	return entry.result, now.Before(entry.expires), true
+}
+
+func (c *responseCache) Put(key string, instance string, result []*types.PowerlineReturn, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= cacheMaxEntries {
+		c.evict()
+	}
+
+	c.entries[key] = &cacheEntry{
+		instance: instance,
+		result:   result,
+		expires:  time.Now().Add(ttl),
+	}
+}
+
+// evict makes room for a new entry by dropping the entries that are too old
+// to be served, or the one closest to expiry when there are none,
+// it must be called with the mutex held
+func (c *responseCache) evict() {
+	now := time.Now()
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.After(entry.expires.Add(cacheMaxStaleness)) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+
+	if len(c.entries) >= cacheMaxEntries {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// StartRefresh returns true if the caller is the one in charge of refreshing
+// the key, so that a single background call is made per stale entry
+func (c *responseCache) StartRefresh(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.refreshing[key]; ok {
+		return false
+	}
+	c.refreshing[key] = struct{}{}
+	return true
+}
+
+func (c *responseCache) EndRefresh(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.refreshing, key)
+}
+
+// Purge drops the results of a plugin instance, so that a
+// restarted plugin does not serve what its predecessor computed
+func (c *responseCache) Purge(instance string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, entry := range c.entries {
+		if entry.instance == instance {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+func TestCacheKey(t *testing.T) {
+	args := json.RawMessage(`{"format":"%H"}`)
+	otherArgs := json.RawMessage(`{"format":"%M"}`)
+	fn := &function{
+		name:     "time",
+		instance: "time",
+		cache:    types.CacheDescriptor{TTL: time.Minute, Env: []string{"TZ", "LANG"}, Cwd: true},
+	}
+	base := &types.Payload{Function: "time", Args: &args, Env: map[string]string{"TZ": "UTC", "LANG": "C"}, Cwd: "/home"}
+
+	tests := []struct {
+		name    string
+		fn      *function
+		payload *types.Payload
+		same    bool
+	}{
+		{
+			name:    "same call",
+			fn:      fn,
+			payload: &types.Payload{Function: "time", Args: &args, Env: map[string]string{"LANG": "C", "TZ": "UTC"}, Cwd: "/home"},
+			same:    true,
+		},
+		{
+			name:    "undeclared environment variable",
+			fn:      fn,
+			payload: &types.Payload{Function: "time", Args: &args, Env: map[string]string{"TZ": "UTC", "LANG": "C", "PWD": "/tmp"}, Cwd: "/home"},
+			same:    true,
+		},
+		{
+			name:    "declared environment variable",
+			fn:      fn,
+			payload: &types.Payload{Function: "time", Args: &args, Env: map[string]string{"TZ": "Europe/Paris", "LANG": "C"}, Cwd: "/home"},
+		},
+		{
+			name:    "arguments",
+			fn:      fn,
+			payload: &types.Payload{Function: "time", Args: &otherArgs, Env: map[string]string{"TZ": "UTC", "LANG": "C"}, Cwd: "/home"},
+		},
+		{
+			name:    "working directory",
+			fn:      fn,
+			payload: &types.Payload{Function: "time", Args: &args, Env: map[string]string{"TZ": "UTC", "LANG": "C"}, Cwd: "/tmp"},
+		},
+		{
+			name:    "other instance",
+			fn:      &function{name: "time", instance: "utc", cache: fn.cache},
+			payload: base,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := cacheKey(fn, base) == cacheKey(test.fn, test.payload); same != test.same {
+				t.Fatalf("expected the keys to be the same: %t, got %t", test.same, same)
+			}
+		})
+	}
+}
+
+func TestResponseCacheGet(t *testing.T) {
+	tests := []struct {
+		name string
+		// expires is when the entry expires, relatively to now
+		expires time.Duration
+		fresh   bool
+		ok      bool
+	}{
+		{name: "fresh", expires: time.Minute, fresh: true, ok: true},
+		{name: "stale", expires: -time.Minute, fresh: false, ok: true},
+		{name: "too old to be served", expires: -cacheMaxStaleness - time.Minute, fresh: false, ok: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newResponseCache()
+			c.Put("key", "time", result("12:00"), test.expires)
+
+			got, fresh, ok := c.Get("key")
+			if ok != test.ok || fresh != test.fresh {
+				t.Fatalf("expected fresh %t and ok %t, got %t and %t", test.fresh, test.ok, fresh, ok)
+			}
+			if ok && content(got) != "12:00" {
+				t.Errorf("unexpected result %v", got)
+			}
+			if _, stored := c.entries["key"]; stored != test.ok {
+				t.Errorf("expected the entry to be kept: %t", test.ok)
+			}
+		})
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		// tooOld is an entry too old to be served, which goes first
+		tooOld  bool
+		evicted string
+	}{
+		{name: "closest to expiry", evicted: "key-0"},
+		{name: "too old to be served", tooOld: true, evicted: "too-old"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newResponseCache()
+			entries := cacheMaxEntries
+			if test.tooOld {
+				c.Put("too-old", "time", result("old"), -cacheMaxStaleness-time.Minute)
+				entries--
+			}
+			for idx := 0; idx < entries; idx++ {
+				c.Put(fmt.Sprintf("key-%d", idx), "time", result("cached"), time.Hour+time.Duration(idx)*time.Second)
+			}
+
+			// replacing an entry does not evict anything
+			c.Put("key-1", "time", result("replaced"), 2*time.Hour)
+			if len(c.entries) != cacheMaxEntries {
+				t.Fatalf("expected %d entries, got %d", cacheMaxEntries, len(c.entries))
+			}
+
+			c.Put("new", "time", result("new"), time.Hour)
+			if len(c.entries) != cacheMaxEntries {
+				t.Fatalf("expected the cache to stay at %d entries, got %d", cacheMaxEntries, len(c.entries))
+			}
+			if _, ok := c.entries[test.evicted]; ok {
+				t.Errorf("expected %s to be evicted", test.evicted)
+			}
+			for _, key := range []string{"new", "key-1"} {
+				if _, ok := c.entries[key]; !ok {
+					t.Errorf("expected %s to be kept", key)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	c := newResponseCache()
+	c.Put("time-1", "time", result("12:00"), time.Minute)
+	c.Put("time-2", "time", result("13:00"), -time.Minute)
+	c.Put("utc-1", "utc", result("10:00"), time.Minute)
+
+	c.Purge("time")
+
+	for key, want := range map[string]bool{"time-1": false, "time-2": false, "utc-1": true} {
+		if _, _, ok := c.Get(key); ok != want {
+			t.Errorf("expected %s to be kept: %t", key, want)
+		}
+	}
+}
+
+func TestResponseCacheRefresh(t *testing.T) {
+	c := newResponseCache()
+
+	if !c.StartRefresh("key") {
+		t.Fatal("expected the first caller to refresh the entry")
+	}
+	if c.StartRefresh("key") {
+		t.Fatal("expected a single refresh per entry")
+	}
+	if !c.StartRefresh("other") {
+		t.Fatal("expected the other entries to be refreshed independently")
+	}
+
+	c.EndRefresh("key")
+	if !c.StartRefresh("key") {
+		t.Fatal("expected the entry to be refreshed again once the refresh is done")
+	}
+}
+
+func TestResultStore(t *testing.T) {
+	s := newResultStore()
+	for idx := 0; idx < resultStoreMaxEntries; idx++ {
+		s.Put(fmt.Sprintf("key-%d", idx), "time", result("stored"))
+	}
+	// key-0 is updated, key-1 is now the one updated the longest ago
+	s.results["key-0"].updated = time.Now().Add(-time.Hour)
+	s.results["key-1"].updated = time.Now().Add(-2 * time.Hour)
+	s.Put("key-0", "time", result("updated"))
+	if len(s.results) != resultStoreMaxEntries {
+		t.Fatalf("expected updating a result not to evict any, got %d results", len(s.results))
+	}
+
+	s.Put("new", "utc", result("new"))
+	if len(s.results) != resultStoreMaxEntries {
+		t.Fatalf("expected the store to stay at %d results, got %d", resultStoreMaxEntries, len(s.results))
+	}
+	if _, ok := s.Get("key-1"); ok {
+		t.Error("expected the result updated the longest ago to be evicted")
+	}
+	if got, ok := s.Get("key-0"); !ok || content(got) != "updated" {
+		t.Errorf("expected the updated result to be kept, got %v", got)
+	}
+
+	s.Purge("time")
+	if len(s.results) != 1 {
+		t.Fatalf("expected only the results of the other instance to be kept, got %d results", len(s.results))
+	}
+	if got, ok := s.Get("new"); !ok || content(got) != "new" {
+		t.Errorf("expected the result of the other instance to be kept, got %v", got)
+	}
+}
+
+func TestCachedCall(t *testing.T) {
+	p := newCountingPlugin(t)
+	m, _ := newTestManager(t, map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin{"counter": p.build})
+	if err := m.Apply(context.Background(), testConfig(pluginEntry(t, "counter", "", ""))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the steps are made in order, against the cache left by the previous one
+	steps := []struct {
+		name string
+		// stale makes the cached results expire before the call
+		stale bool
+		// reconfigure restarts the plugin before the call
+		reconfigure bool
+		want        string
+		// cached is what the cache holds once the refresh, if any, is done
+		cached string
+	}{
+		{name: "miss", want: "call 1", cached: "call 1"},
+		{name: "hit", want: "call 1", cached: "call 1"},
+		{name: "stale result served while it is refreshed", stale: true, want: "call 1", cached: "call 2"},
+		{name: "refreshed", want: "call 2", cached: "call 2"},
+		{name: "purged on restart", reconfigure: true, want: "call 3", cached: "call 3"},
+	}
+
+	key := cacheKey(&function{instance: "counter", name: "cached"}, &types.Payload{Function: "cached"})
+	for _, step := range steps {
+		if step.stale {
+			m.cache.mutex.Lock()
+			for _, entry := range m.cache.entries {
+				entry.expires = time.Now().Add(-time.Minute)
+			}
+			m.cache.mutex.Unlock()
+		}
+		if step.reconfigure {
+			if err := m.Apply(context.Background(), testConfig(pluginEntry(t, "counter", "", "restarted: true"))); err != nil {
+				t.Fatalf("%s: unexpected error: %s", step.name, err)
+			}
+			if _, _, ok := m.cache.Get(key); ok {
+				t.Fatalf("%s: expected the results of the stopped plugin to be purged", step.name)
+			}
+			if _, ok := m.lastResults.Get(key); ok {
+				t.Fatalf("%s: expected the last results of the stopped plugin to be purged", step.name)
+			}
+		}
+
+		got, err := call(m, "cached")
+		if err != nil || got != step.want {
+			t.Fatalf("%s: expected %q, got %q, %v", step.name, step.want, got, err)
+		}
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			cached, fresh, ok := m.cache.Get(key)
+			if ok && fresh && content(cached) == step.cached {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected %q to be cached, got %v", step.name, step.cached, cached)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoSuchFunction is returned when no running plugin exposes the called function
+	ErrNoSuchFunction = errors.New("no such function")
+	// ErrAmbiguousFunction is returned when a bare function name is exposed by several plugins
+	ErrAmbiguousFunction = errors.New("ambiguous function")
+	// ErrCircuitOpen is returned when calls to a plugin are short-circuited
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	errCallTimeout = errors.New("plugin call did not complete in time")
+)
+
+// resultStoreMaxEntries bounds the number of results kept in the result store
+const resultStoreMaxEntries = 4096
+
+type storedResult struct {
+	instance string
+	result   []*types.PowerlineReturn
+	updated  time.Time
+}
+
+// resultStore keeps the last successful result of every function call, keyed
+// like the response cache so that a result is only rendered in place of a
+// call made from the same context
+type resultStore struct {
+	mutex   *sync.Mutex
+	results map[string]*storedResult
+}
+
+func newResultStore() *resultStore {
+	return &resultStore{
+		mutex:   &sync.Mutex{},
+		results: make(map[string]*storedResult),
+	}
+}
+
+func (s *resultStore) Put(key string, instance string, result []*types.PowerlineReturn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.results[key]; !ok && len(s.results) >= resultStoreMaxEntries {
+		s.evict()
+	}
+
+	s.results[key] = &storedResult{
+		instance: instance,
+		result:   result,
+		updated:  time.Now(),
+	}
+}
+
+func (s *resultStore) Get(key string) ([]*types.PowerlineReturn, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.results[key]
+	if !ok {
+		return nil, false
+	}
+	return stored.result, true
+}
+
+// evict drops the result that was updated the longest ago,
+// it must be called with the mutex held
+func (s *resultStore) evict() {
+	var oldestKey string
+	var oldest time.Time
+	for key, stored := range s.results {
+		if oldestKey == "" || stored.updated.Before(oldest) {
+			oldestKey, oldest = key, stored.updated
+		}
+	}
+	delete(s.results, oldestKey)
+}
+
+// Purge drops the results of a plugin instance, so that a
+// restarted plugin does not render what its predecessor computed
+func (s *resultStore) Purge(instance string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, stored := range s.results {
+		if stored.instance == instance {
+			delete(s.results, key)
+		}
+	}
+}
+
+// Call renders a segment by calling the function named in the payload, either as
+// `plugin.function` or as `function` when a single plugin exposes it. The call is
+// bounded by the function's timeout and by the given context, when either expires
+// the last good result or the configured placeholder is returned instead.
+// The arguments are checked against the schema of the function, if it has one.
+// Functions with a cache TTL are served from the cache when possible, and
+// functions that might belong to a plugin still starting render as loading.
+// Once the plugins are released for a new server, the functions are answered
+// with their last result.
+func (m *Manager) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+	snap := m.load()
+	fn, ok := snap.functions[payload.Function]
+	if !ok {
+		if candidates, ok := snap.ambiguous[payload.Function]; ok {
+			return nil, fmt.Errorf("%w %s, use one of %s", ErrAmbiguousFunction, payload.Function, strings.Join(candidates, ", "))
+		}
+		if m.isPending(snap, payload.Function) {
+			return m.loading(snap), nil
+		}
+		return nil, fmt.Errorf("%w %s", ErrNoSuchFunction, payload.Function)
+	}
+
+	start := time.Now()
+	if err := validateArgs(fn, payload); err != nil {
+		m.metrics.Request(fn, requestStatusError, start)
+		return nil, err
+	}
+
+	if snap.released {
+		m.metrics.Request(fn, requestStatusOK, start)
+		return m.releasedResult(snap, fn, payload), nil
+	}
+
+	var result []*types.PowerlineReturn
+	var err error
+	if fn.cache.TTL > 0 {
+		result, err = m.cachedCall(ctx, log, snap, fn, payload)
+	} else {
+		result, err = m.invoke(ctx, log, snap, fn, payload)
+	}
+
+	status := requestStatusOK
+	if errors.Is(err, errCallTimeout) {
+		status = requestStatusTimeout
+		result, err = m.fallback(snap, fn, payload), nil
+	} else if err != nil {
+		status = requestStatusError
+	}
+	m.metrics.Request(fn, status, start)
+
+	return result, err
+}
+
+// cachedCall serves the result from the cache when there is one, a
+// stale result is returned right away and refreshed in the background
+func (m *Manager) cachedCall(ctx context.Context, log *zap.Logger, snap *snapshot, fn *function, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+	key := cacheKey(fn, payload)
+	if result, fresh, ok := m.cache.Get(key); ok {
+		if fresh {
+			m.metrics.Cache(fn, cacheResultHit)
+		} else {
+			m.metrics.Cache(fn, cacheResultStale)
+			m.refresh(log, fn, payload, key)
+		}
+		return result, nil
+	}
+
+	m.metrics.Cache(fn, cacheResultMiss)
+	result, err := m.invoke(ctx, log, snap, fn, payload)
+	if err != nil {
+		return nil, err
+	}
+	m.cache.Put(key, fn.instance, result, fn.cache.TTL)
+	return result, nil
+}
+
+// refresh recomputes a stale cache entry in the background, the call is not tied
+// to the request that found the entry stale. The function is looked up again since
+// the plugin may have been stopped or restarted meanwhile, and the result is dropped
+// when the plugin that computed it is no longer the one running.
+func (m *Manager) refresh(log *zap.Logger, fn *function, payload *types.Payload, key string) {
+	if !m.cache.StartRefresh(key) {
+		return
+	}
+
+	refreshPayload := *payload
+	go func() {
+		defer m.cache.EndRefresh(key)
+
+		snap := m.load()
+		current, ok := snap.functions[refreshPayload.Function]
+		if !ok || current.plugin != fn.plugin {
+			return
+		}
+
+		result, err := m.invoke(context.Background(), log, snap, current, &refreshPayload)
+		if err != nil {
+			log.Debug("could not refresh cached result", zap.String("plugin", current.instance), zap.String("function", current.name), zap.Error(err))
+			return
+		}
+
+		// the cache is purged once a stopped plugin is no longer registered
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if instance, ok := m.instances[current.instance]; ok && instance.plugin == current.plugin {
+			m.cache.Put(key, current.instance, result, current.cache.TTL)
+		}
+	}()
+}
+
+// invoke runs the function through the circuit breaker, bounded by its timeout,
+// errCallTimeout is returned when the plugin did not answer in time
+func (m *Manager) invoke(ctx context.Context, log *zap.Logger, snap *snapshot, fn *function, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+	if !fn.breaker.Allow() {
+		fn.stats.Rejected()
+		m.metrics.PluginError(fn, pluginErrorRejected)
+		return nil, fmt.Errorf("%w for plugin %s", ErrCircuitOpen, fn.instance)
+	}
+
+	// The plugin only knows about the bare function name
+	pluginPayload := *payload
+	pluginPayload.Function = fn.name
+
+	var result []*types.PowerlineReturn
+	returned, err := runBounded(ctx, fn.timeout, func(ctx context.Context) error {
+		var err error
+		result, err = fn.plugin.RunCall(ctx, fn.log, &pluginPayload)
+		return err
+	}, nil)
+	if !returned {
+		log.Warn(
+			"plugin call did not complete in time",
+			zap.String("plugin", fn.instance),
+			zap.Duration("timeout", fn.timeout),
+			zap.Error(err),
+		)
+		// the client going away is not the plugin's fault
+		if errors.Is(err, context.DeadlineExceeded) {
+			fn.stats.Timeout(errCallTimeout)
+			m.metrics.PluginError(fn, pluginErrorTimeout)
+			m.recordFailure(log, snap, fn)
+		} else {
+			fn.breaker.Abort()
+		}
+		return nil, errCallTimeout
+	}
+	if err != nil {
+		fn.stats.Error(err)
+		m.metrics.PluginError(fn, pluginErrorError)
+		m.recordFailure(log, snap, fn)
+		return nil, err
+	}
+
+	fn.stats.Success()
+	fn.breaker.Success()
+	m.lastResults.Put(cacheKey(fn, payload), fn.instance, result)
+	return result, nil
+}
+
+func (m *Manager) recordFailure(log *zap.Logger, snap *snapshot, fn *function) {
+	if fn.breaker.Failure(snap.breaker) {
+		log.Warn(
+			"too many consecutive failures, short-circuiting plugin calls",
+			zap.String("plugin", fn.instance),
+			zap.Duration("cooldown", snap.breaker.Cooldown),
+		)
+	}
+}
+
+// fallback returns what to render in place of a call that did not complete
+func (m *Manager) fallback(snap *snapshot, fn *function, payload *types.Payload) []*types.PowerlineReturn {
+	if snap.timeouts.UseLastResult {
+		if result, ok := m.lastResults.Get(cacheKey(fn, payload)); ok {
+			return result
+		}
+	}
+
+	if snap.timeouts.Placeholder == "" {
+		return nil
+	}
+
+	return []*types.PowerlineReturn{
+		{
+			Content:        snap.timeouts.Placeholder,
+			HighlightGroup: []string{"gwl:timeout", "information:regular"},
+		},
+	}
+}
+
+// releasedResult returns what to render for a function whose plugin was released
+// for a new server: the result it last returned for the same call, and the loading
+// placeholder when there is none
+func (m *Manager) releasedResult(snap *snapshot, fn *function, payload *types.Payload) []*types.PowerlineReturn {
+	if result, ok := m.lastResults.Get(cacheKey(fn, payload)); ok {
+		return result
+	}
+	return m.loading(snap)
+}
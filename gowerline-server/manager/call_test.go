@@ -0,0 +1,109 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+// countingPlugin exposes `count`, whose calls render how many calls were made so far,
+// and `cached` which does the same and whose results are cached for an hour. While
+// block is set, the calls block until release is closed, whatever their context.
+type countingPlugin struct {
+	calls   int32
+	block   int32
+	release chan struct{}
+}
+
+func newCountingPlugin(t *testing.T) *countingPlugin {
+	p := &countingPlugin{release: make(chan struct{})}
+	t.Cleanup(func() {
+		close(p.release)
+	})
+	return p
+}
+
+func (p *countingPlugin) build(pCfg *plugins.PluginConfig) *plugins.Plugin {
+	return &plugins.Plugin{
+		Name: pCfg.PluginName,
+		Start: func(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+			return &types.PluginStartData{Metadata: types.PluginMetadata{Functions: []types.FunctionDescriptor{
+				{Name: "count"},
+				{Name: "cached", Cache: &types.CacheDescriptor{TTL: time.Hour}},
+			}}}, nil
+		},
+		Call: func(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+			if atomic.LoadInt32(&p.block) != 0 {
+				<-p.release
+			}
+			return result(fmt.Sprintf("call %d", atomic.AddInt32(&p.calls, 1))), nil
+		},
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		useLastResult bool
+		placeholder   string
+		// previous makes a successful call before the one that times out
+		previous bool
+		// cancel makes the client go away rather than the plugin time out
+		cancel   bool
+		want     string
+		failures int
+	}{
+		{name: "last result", useLastResult: true, placeholder: "...", previous: true, want: "call 1", failures: 1},
+		{name: "no last result", useLastResult: true, placeholder: "...", want: "...", failures: 1},
+		{name: "placeholder", placeholder: "...", previous: true, want: "...", failures: 1},
+		{name: "hidden segment", previous: true, want: "", failures: 1},
+		{name: "client gone", useLastResult: true, placeholder: "...", previous: true, cancel: true, want: "call 1", failures: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newCountingPlugin(t)
+			m, _ := newTestManager(t, map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin{"counter": p.build})
+
+			cfg := testConfig(pluginEntry(t, "counter", "", ""))
+			cfg.Timeouts.Call = 50 * time.Millisecond
+			cfg.Timeouts.UseLastResult = test.useLastResult
+			cfg.Timeouts.Placeholder = test.placeholder
+			if err := m.Apply(context.Background(), cfg); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if test.previous {
+				if got, err := call(m, "count"); err != nil || got != "call 1" {
+					t.Fatalf("unexpected result %q, %v", got, err)
+				}
+			}
+
+			atomic.StoreInt32(&p.block, 1)
+			ctx := context.Background()
+			if test.cancel {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			got, err := m.Call(ctx, zap.NewNop(), &types.Payload{Function: "count"})
+			if err != nil {
+				t.Fatalf("expected the call to fall back, got %s", err)
+			}
+			if content(got) != test.want || (test.want == "" && len(got) != 0) {
+				t.Errorf("expected %q to be rendered, got %v", test.want, got)
+			}
+
+			status := m.load().functions["count"].breaker.Status()
+			if status.ConsecutiveFailures != test.failures {
+				t.Errorf("expected %d failures to be counted, got %d", test.failures, status.ConsecutiveFailures)
+			}
+		})
+	}
+}
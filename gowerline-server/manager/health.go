@@ -0,0 +1,217 @@
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+// healthTimeout bounds the Health hook of the plugins, the status and
+// the metrics do not wait for a plugin any longer than that
+const healthTimeout = time.Second
+
+// pluginStats tracks the state and the calls of a configured plugin,
+// it outlives the plugin instance so failures to start are reported
+type pluginStats struct {
+	mutex         *sync.Mutex
+	state         string
+	lastError     string
+	lastErrorTime time.Time
+	lastSuccess   time.Time
+	calls         types.CallCounters
+}
+
+func newPluginStats() *pluginStats {
+	return &pluginStats{
+		mutex: &sync.Mutex{},
+		state: types.PluginStateStarting,
+	}
+}
+
+func (s *pluginStats) SetState(state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = state
+}
+
+// Stopped marks the plugin as stopped, err is the reason why if any
+func (s *pluginStats) Stopped(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.state = types.PluginStateStopped
+	if err != nil {
+		s.lastError = err.Error()
+		s.lastErrorTime = time.Now()
+	}
+}
+
+func (s *pluginStats) Success() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls.Total++
+	s.lastSuccess = time.Now()
+}
+
+func (s *pluginStats) Error(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls.Total++
+	s.calls.Errors++
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+func (s *pluginStats) Timeout(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls.Total++
+	s.calls.Timeouts++
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+}
+
+func (s *pluginStats) Rejected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls.Total++
+	s.calls.Rejected++
+}
+
+// status fills in what the manager knows about the plugin, the
+// health reported by the plugin itself is merged in by the caller
+func (s *pluginStats) status() types.PluginStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := types.PluginStatus{
+		State:     s.state,
+		LastError: s.lastError,
+		Calls:     s.calls,
+	}
+	if !s.lastErrorTime.IsZero() {
+		lastErrorTime := s.lastErrorTime
+		status.LastErrorTime = &lastErrorTime
+	}
+	if !s.lastSuccess.IsZero() {
+		lastSuccess := s.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+
+	return status
+}
+
+// setStats registers the stats of a plugin, they are reset when it is restarted
+func (m *Manager) setStats(name string, stats *pluginStats) {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	m.stats[name] = stats
+}
+
+// Status returns the status of the configured plugins, keyed by instance name
+func (m *Manager) Status(ctx context.Context) map[string]types.PluginStatus {
+	m.statsMutex.Lock()
+	stats := make(map[string]*pluginStats, len(m.stats))
+	for name, s := range m.stats {
+		stats[name] = s
+	}
+	m.statsMutex.Unlock()
+
+	snap := m.load()
+	result := make(map[string]types.PluginStatus, len(stats))
+	resultMutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for name, s := range stats {
+		wg.Add(1)
+		go func(name string, s *pluginStats) {
+			defer wg.Done()
+			status := m.pluginStatus(ctx, snap, name, s)
+			resultMutex.Lock()
+			result[name] = status
+			resultMutex.Unlock()
+		}(name, s)
+	}
+	wg.Wait()
+
+	return result
+}
+
+// PluginStatus returns the status of a single configured plugin
+func (m *Manager) PluginStatus(ctx context.Context, name string) (types.PluginStatus, bool) {
+	m.statsMutex.Lock()
+	s, ok := m.stats[name]
+	m.statsMutex.Unlock()
+	if !ok {
+		return types.PluginStatus{}, false
+	}
+
+	return m.pluginStatus(ctx, m.load(), name, s), true
+}
+
+func (m *Manager) pluginStatus(ctx context.Context, snap *snapshot, name string, s *pluginStats) types.PluginStatus {
+	status := s.status()
+
+	var instance *pluginInstance
+	for _, i := range snap.instances {
+		if i.name == name {
+			instance = i
+			break
+		}
+	}
+	if instance == nil {
+		if status.State == types.PluginStateRunning {
+			status.State = types.PluginStateStopped
+		}
+		return status
+	}
+
+	status.PluginMetadata = instance.plugin.Metadata
+	status.Breaker = instance.breaker.Status()
+
+	var reported *types.PluginHealth
+	_, err := runBounded(ctx, healthTimeout, func(ctx context.Context) (err error) {
+		reported, err = instance.plugin.RunHealth(ctx, instance.log)
+		return err
+	}, nil)
+	// reported must not be read unless the hook returned in time
+	var health *types.PluginHealth
+	if err != nil {
+		m.log.Warn("could not get the health of the plugin", zap.String("plugin", name), zap.Error(err))
+		health = &types.PluginHealth{Healthy: false, LastError: err.Error()}
+	} else {
+		health = reported
+	}
+	status.Health = health
+
+	if health != nil {
+		if status.LastError == "" {
+			status.LastError = health.LastError
+		}
+		if health.LastRefresh != nil && (status.LastSuccess == nil || health.LastRefresh.After(*status.LastSuccess)) {
+			status.LastSuccess = health.LastRefresh
+		}
+	}
+
+	if status.State == types.PluginStateRunning && isDegraded(status) {
+		status.State = types.PluginStateDegraded
+	}
+
+	return status
+}
+
+// isDegraded tells whether a running plugin is failing, either
+// because it says so or because its last call did not succeed
+func isDegraded(status types.PluginStatus) bool {
+	if status.Breaker.State != types.BreakerStateClosed {
+		return true
+	}
+	if status.Health != nil && !status.Health.Healthy {
+		return true
+	}
+	if status.LastErrorTime != nil {
+		return status.LastSuccess == nil || status.LastErrorTime.After(*status.LastSuccess)
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+func TestStatusHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		health func(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error)
+		state  string
+	}{
+		{
+			name:  "no health hook",
+			state: types.PluginStateRunning,
+		},
+		{
+			name: "healthy",
+			health: func(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+				return &types.PluginHealth{Healthy: true}, nil
+			},
+			state: types.PluginStateRunning,
+		},
+		{
+			name: "unhealthy",
+			health: func(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+				return &types.PluginHealth{Healthy: false, LastError: "token expired"}, nil
+			},
+			state: types.PluginStateDegraded,
+		},
+		{
+			name: "failing hook",
+			health: func(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+				return nil, errors.New("could not check")
+			},
+			state: types.PluginStateDegraded,
+		},
+		{
+			name: "hook ignoring its context",
+			health: func(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+				time.Sleep(3 * healthTimeout)
+				return &types.PluginHealth{Healthy: true}, nil
+			},
+			state: types.PluginStateDegraded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _ := newTestManager(t, map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin{
+				"time": func(pCfg *plugins.PluginConfig) *plugins.Plugin {
+					plg := stubPlugin("time")(pCfg)
+					plg.Health = test.health
+					return plg
+				},
+			})
+			if err := m.Apply(context.Background(), testConfig(pluginEntry(t, "time", "", ""))); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			start := time.Now()
+			status := m.Status(context.Background())["time"]
+			if elapsed := time.Since(start); elapsed > 2*healthTimeout {
+				t.Errorf("expected the status not to wait for the plugin, it took %s", elapsed)
+			}
+			if status.State != test.state {
+				t.Errorf("expected the plugin to be %s, got %s", test.state, status.State)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// defaultLogLevel makes a plugin log at the level of the server again
+	defaultLogLevel = "default"
+	// logLevelTimeout bounds the change of the level of the plugins running out of process
+	logLevelTimeout = time.Second
+)
+
+// ErrInvalidLogLevel is returned for the levels zap does not know about
+var ErrInvalidLogLevel = errors.New("invalid log level")
+
+// LogLevels returns the level of the logs of the server, and the ones of the plugins
+// that log at their own level
+func (m *Manager) LogLevels() types.LogLevels {
+	return m.logs.Levels()
+}
+
+// SetLogLevel changes the level of the logs of the server, or the one of a plugin
+// when plugin is set. The `default` level makes the plugin log at the level of the
+// server again. The levels are set back to the configured ones on reload.
+func (m *Manager) SetLogLevel(ctx context.Context, plugin string, value string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if plugin != "" {
+		if _, err := m.configuredPlugin(plugin); err != nil {
+			return err
+		}
+	}
+
+	if plugin != "" && value == defaultLogLevel {
+		m.logs.ResetPluginLevel(plugin)
+	} else {
+		level, err := zapcore.ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("%w %s", ErrInvalidLogLevel, value)
+		}
+		if plugin != "" {
+			m.logs.SetPluginLevel(plugin, level)
+		} else {
+			m.logs.SetLevel(level)
+		}
+	}
+	m.log.Info("changed log level", zap.String("plugin", plugin), zap.String("level", value))
+
+	m.pushLogLevels(ctx)
+	return nil
+}
+
+// pushLogLevels tells the plugins running out of process about the level they log at,
+// the native ones follow it already. It must be called with the mutex held.
+func (m *Manager) pushLogLevels(ctx context.Context) {
+	for name, instance := range m.instances {
+		ctx, cancel := context.WithTimeout(ctx, logLevelTimeout)
+		err := instance.plugin.SetLogLevel(ctx, m.logs.PluginLevel(name))
+		cancel()
+		if err != nil {
+			m.log.Warn("could not change the log level of the plugin", zap.String("plugin", name), zap.Error(err))
+		}
+	}
+}
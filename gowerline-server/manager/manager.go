@@ -0,0 +1,737 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/logging"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// pluginInstance is a plugin loaded from a given configuration entry. Only
+// the name, log, plugin, breaker, stats, gatherer and started fields may be accessed without holding
+// the mutex of the manager, they are never modified once the plugin is started.
+type pluginInstance struct {
+	name string
+	// log is given to the plugin, it logs at the level of the plugin
+	log    *zap.Logger
+	config config.ConfigPlugin
+	// rawConfig is the serialised `config` node, used to
+	// detect configuration changes between reloads
+	rawConfig []byte
+	plugin    *plugins.Plugin
+	breaker   *breaker
+	stats     *pluginStats
+	db        *bolt.DB
+	// gatherer collects the metrics registered by the plugin
+	gatherer prometheus.Gatherer
+	// started is when the plugin was registered
+	started time.Time
+}
+
+// function is a function exposed by a running plugin
+type function struct {
+	// name is the name of the function as known by the plugin
+	name string
+	// instance is the name of the plugin instance exposing it
+	instance string
+	log      *zap.Logger
+	plugin   *plugins.Plugin
+	breaker  *breaker
+	stats    *pluginStats
+	timeout  time.Duration
+	cache    types.CacheDescriptor
+	// argsSchema validates the arguments of the calls, if set
+	argsSchema *types.Schema
+}
+
+// snapshot is an immutable view of the loaded plugins, it is
+// swapped atomically every time the set of plugins changes
+type snapshot struct {
+	functions map[string]*function
+	// ambiguous maps the bare names registered by several
+	// plugins to their qualified names
+	ambiguous map[string][]string
+	instances []*pluginInstance
+	// pending holds the names of the plugins that are not running yet,
+	// pendingFunctions the ones among them declaring each function
+	pending          map[string]bool
+	pendingFunctions map[string][]string
+	// starting is set while plugins that are not lazy are starting
+	starting bool
+	// released is set once the plugins are released for the server replacing
+	// this one, the functions are then answered from their last results
+	released bool
+	timeouts config.ConfigTimeouts
+	breaker  config.ConfigBreaker
+	startup  config.ConfigStartup
+	cfg      *config.Config
+}
+
+// Manager owns the lifecycle of the plugins: it loads, starts, stops
+// and reloads them according to the configuration file
+type Manager struct {
+	log        *zap.Logger
+	logs       *logging.Logging
+	configFile string
+	pluginsDir string
+	homeDir    string
+	// newPlugin loads the native plugins, it is swapped for stubs in the tests
+	newPlugin func(ctx context.Context, log *zap.Logger, filePath string, pluginConfig *plugins.PluginConfig) (*plugins.Plugin, error)
+
+	// mutex serialises the changes made to the set of plugins
+	mutex     *sync.Mutex
+	cfg       *config.Config
+	instances map[string]*pluginInstance
+	// pending holds the plugins that are starting, or
+	// waiting for their first use when they are lazy
+	pending map[string]*pendingStart
+	order   []string
+	// disabled holds the plugins disabled at runtime, and persisted
+	// the ones among them that stay disabled when the server restarts
+	disabled  map[string]bool
+	persisted map[string]bool
+	// released is set while the server replacing this one starts the plugins
+	released bool
+
+	current     atomic.Value
+	lastResults *resultStore
+	cache       *responseCache
+	metrics     *metrics
+
+	// statsMutex guards stats, which are kept for every configured plugin
+	statsMutex *sync.Mutex
+	stats      map[string]*pluginStats
+}
+
+func NewManager(logs *logging.Logging, configFile string, pluginsDir string, homeDir string) *Manager {
+	log := logs.Logger()
+	m := &Manager{
+		log:         log,
+		logs:        logs,
+		configFile:  configFile,
+		pluginsDir:  pluginsDir,
+		homeDir:     homeDir,
+		newPlugin:   plugins.NewPlugin,
+		mutex:       &sync.Mutex{},
+		cfg:         &config.Config{},
+		instances:   make(map[string]*pluginInstance),
+		pending:     make(map[string]*pendingStart),
+		order:       make([]string, 0),
+		disabled:    make(map[string]bool),
+		persisted:   make(map[string]bool),
+		lastResults: newResultStore(),
+		cache:       newResponseCache(),
+		statsMutex:  &sync.Mutex{},
+		stats:       make(map[string]*pluginStats),
+	}
+	m.metrics = newMetrics(m)
+	m.current.Store(&snapshot{
+		functions: make(map[string]*function),
+		ambiguous: make(map[string][]string),
+		instances: make([]*pluginInstance, 0),
+		pending:   make(map[string]bool),
+		cfg:       m.cfg,
+
+		pendingFunctions: make(map[string][]string),
+	})
+
+	persisted, err := loadDisabledPlugins()
+	if err != nil {
+		log.Error("could not load the plugins disabled at runtime, enabling them", zap.String("file", disabledPluginsFile()), zap.Error(err))
+	}
+	for _, name := range persisted {
+		m.disabled[name] = true
+		m.persisted[name] = true
+	}
+
+	return m
+}
+
+// Reload re-reads the configuration file and applies it
+func (m *Manager) Reload(ctx context.Context) error {
+	m.log.Info("reloading configuration", zap.String("config", m.configFile))
+
+	cfg, err := config.NewConfigFromFile(m.configFile)
+	if err != nil {
+		return err
+	}
+
+	return m.Apply(ctx, cfg)
+}
+
+// Config returns the configuration applied last, without
+// waiting for the changes to the plugins in progress
+func (m *Manager) Config() *config.Config {
+	return m.load().cfg
+}
+
+// Apply diffs the given configuration with the running plugins. Plugins that were
+// removed or disabled are stopped, new ones are started, and the ones for which
+// the configuration changed are restarted. Plugins are started concurrently and
+// Apply waits for them, except for the lazy ones which are started on first use.
+// Plugins that fail to load are reported in the returned error but do not prevent
+// the others from being loaded. The native plugins of the plugins directory are
+// added to the configuration first when it asks for them to be discovered.
+func (m *Manager) Apply(ctx context.Context, cfg *config.Config) error {
+	eager, errs := m.schedule(ctx, cfg)
+	return multierr.Append(errs, m.startEager(ctx, eager))
+}
+
+// ApplyInBackground is Apply, except that it returns as soon as the plugins to start are
+// registered as starting, so that their functions render as loading rather than being
+// unknown. The result of Apply is sent on the returned channel once they are started.
+func (m *Manager) ApplyInBackground(ctx context.Context, cfg *config.Config) <-chan error {
+	eager, errs := m.schedule(ctx, cfg)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- multierr.Append(errs, m.startEager(ctx, eager))
+	}()
+	return result
+}
+
+// schedule stops the plugins that are no longer wanted, and registers the ones
+// to start as pending, the eager ones are returned to be started
+func (m *Manager) schedule(ctx context.Context, cfg *config.Config) (map[string]*pendingStart, error) {
+	var errs error
+	if err := m.logs.Configure(cfg.LogSettings()); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	if cfg.DiscoverPlugins {
+		if err := cfg.AddDiscoveredPlugins(m.pluginsDir); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("could not discover plugins: %w", err))
+		}
+	}
+
+	m.mutex.Lock()
+	if m.released {
+		m.mutex.Unlock()
+		return nil, multierr.Append(errs, ErrReleased)
+	}
+
+	wanted := make(map[string]config.ConfigPlugin)
+	configured := make(map[string]bool)
+	// the plugins disabled at runtime keep their place in the
+	// order of the manager, in case they are enabled again
+	configuredOrder := make([]string, 0)
+	order := make([]string, 0)
+	for _, plgCfg := range cfg.Plugins {
+		if plgCfg.Disabled {
+			m.log.Info("skipping disabled plugin", zap.String("plugin", plgCfg.Name))
+			continue
+		}
+		if configured[plgCfg.Name] {
+			m.log.Warn("plugin is configured more than once, ignoring duplicate", zap.String("plugin", plgCfg.Name))
+			continue
+		}
+		configured[plgCfg.Name] = true
+		configuredOrder = append(configuredOrder, plgCfg.Name)
+		if m.disabled[plgCfg.Name] {
+			m.log.Info("skipping plugin disabled at runtime", zap.String("plugin", plgCfg.Name))
+			continue
+		}
+		wanted[plgCfg.Name] = plgCfg
+		order = append(order, plgCfg.Name)
+	}
+
+	toStart := make(map[string][]byte)
+	toStop := make(map[string]*pluginInstance)
+	for _, name := range order {
+		rawConfig, err := serialiseConfig(wanted[name])
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("invalid configuration for plugin %s: %w", name, err))
+			continue
+		}
+
+		if pending, ok := m.pending[name]; ok && bytes.Equal(pending.rawConfig, rawConfig) {
+			pending.config = wanted[name]
+			continue
+		}
+
+		instance, ok := m.instances[name]
+		if !ok {
+			toStart[name] = rawConfig
+			continue
+		}
+
+		if !bytes.Equal(instance.rawConfig, rawConfig) {
+			m.log.Info("configuration changed, restarting plugin", zap.String("plugin", name))
+			toStop[name] = instance
+			toStart[name] = rawConfig
+			continue
+		}
+
+		// pick up the settings that do not require a restart
+		instance.config = wanted[name]
+	}
+
+	for name, instance := range m.instances {
+		if _, ok := wanted[name]; !ok {
+			m.log.Info("plugin removed from the configuration", zap.String("plugin", name))
+			toStop[name] = instance
+		}
+	}
+	// plugins still starting notice they are no longer wanted when they are done
+	for name := range m.pending {
+		if _, ok := wanted[name]; !ok {
+			delete(m.pending, name)
+		}
+	}
+	m.pruneStats(configured)
+	for name := range configured {
+		if m.disabled[name] {
+			m.setDisabledStats(name)
+		}
+	}
+
+	// Hide the plugins we are about to stop before actually stopping them
+	for name := range toStop {
+		delete(m.instances, name)
+	}
+
+	eager := make(map[string]*pendingStart)
+	for _, name := range order {
+		rawConfig, ok := toStart[name]
+		if !ok {
+			continue
+		}
+
+		pending := m.newPending(name, wanted[name], rawConfig)
+		if pending.started {
+			eager[name] = pending
+		}
+	}
+
+	m.cfg = cfg
+	m.order = configuredOrder
+	m.swap()
+	m.pushLogLevels(ctx)
+	m.mutex.Unlock()
+
+	// the calls and the other changes do not wait on the plugins that are
+	// slow to stop, the restarted ones are only started once they stopped
+	if err := m.stopInstances(ctx, toStop, m.stopInstance); err != nil {
+		errs = multierr.Append(errs, err)
+	}
+
+	return eager, errs
+}
+
+// startEager starts the plugins concurrently and waits for them
+func (m *Manager) startEager(ctx context.Context, eager map[string]*pendingStart) error {
+	var errs error
+	errsMutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for name, pending := range eager {
+		wg.Add(1)
+		go func(name string, pending *pendingStart) {
+			defer wg.Done()
+			if err := m.runStart(ctx, name, pending); err != nil {
+				errsMutex.Lock()
+				errs = multierr.Append(errs, err)
+				errsMutex.Unlock()
+			}
+		}(name, pending)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// StopAll stops every running plugin, each of them is given
+// the configured stop timeout to do so
+func (m *Manager) StopAll(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	instances := m.instances
+	m.instances = make(map[string]*pluginInstance)
+	m.pending = make(map[string]*pendingStart)
+	m.swap()
+
+	return m.stopInstances(ctx, instances, m.stopInstance)
+}
+
+// Release stops every running plugin so that the server replacing this one can use
+// their storage, and keeps answering the calls to their functions with the results
+// they last returned meanwhile. The plugins are not started again until Resume.
+func (m *Manager) Release(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.log.Info("releasing the plugins for the new server")
+	m.released = true
+	instances := m.instances
+	m.instances = make(map[string]*pluginInstance)
+	m.pending = make(map[string]*pendingStart)
+	released := *m.load()
+	released.released = true
+	m.current.Store(&released)
+
+	return m.stopInstances(ctx, instances, m.releaseInstance)
+}
+
+// Resume starts the plugins again after they were released for a server that did
+// not manage to replace this one, like ApplyInBackground does
+func (m *Manager) Resume(ctx context.Context) <-chan error {
+	m.mutex.Lock()
+	m.log.Info("starting the released plugins again")
+	m.released = false
+	cfg := m.cfg
+	m.mutex.Unlock()
+
+	return m.ApplyInBackground(ctx, cfg)
+}
+
+// stopInstances stops the instances concurrently, they must no longer be registered
+func (m *Manager) stopInstances(ctx context.Context, instances map[string]*pluginInstance, stop func(context.Context, *pluginInstance) error) error {
+	var errs error
+	errsMutex := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, instance := range instances {
+		wg.Add(1)
+		go func(instance *pluginInstance) {
+			defer wg.Done()
+			if err := stop(ctx, instance); err != nil {
+				errsMutex.Lock()
+				errs = multierr.Append(errs, err)
+				errsMutex.Unlock()
+			}
+		}(instance)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// newPending registers a plugin to start, the lazy ones wait for their first use
+// and the others are marked as started for the caller to start them. It must be
+// called with the mutex held.
+func (m *Manager) newPending(name string, plgCfg config.ConfigPlugin, rawConfig []byte) *pendingStart {
+	pending := &pendingStart{
+		config:    plgCfg,
+		rawConfig: rawConfig,
+		stats:     newPluginStats(),
+	}
+	if plgCfg.Lazy {
+		pending.stats.SetState(types.PluginStateIdle)
+	} else {
+		pending.started = true
+	}
+	m.pending[name] = pending
+	m.setStats(name, pending.stats)
+
+	return pending
+}
+
+// pruneStats forgets about the plugins that are no longer configured
+func (m *Manager) pruneStats(configured map[string]bool) {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	for name := range m.stats {
+		if !configured[name] {
+			delete(m.stats, name)
+		}
+	}
+}
+
+func (m *Manager) load() *snapshot {
+	return m.current.Load().(*snapshot)
+}
+
+// swap builds a new snapshot from the running instances and publishes it,
+// it must be called with the mutex held
+func (m *Manager) swap() {
+	snap := &snapshot{
+		functions: make(map[string]*function),
+		ambiguous: make(map[string][]string),
+		instances: make([]*pluginInstance, 0, len(m.instances)),
+		pending:   make(map[string]bool, len(m.pending)),
+		timeouts:  m.cfg.Timeouts,
+		breaker:   m.cfg.BreakerSettings(),
+		startup:   m.cfg.StartupSettings(),
+		cfg:       m.cfg,
+
+		pendingFunctions: make(map[string][]string),
+	}
+	for name, pending := range m.pending {
+		snap.pending[name] = true
+		if !pending.config.Lazy {
+			snap.starting = true
+		}
+		for _, fn := range pending.config.Functions {
+			snap.pendingFunctions[fn] = append(snap.pendingFunctions[fn], name)
+		}
+	}
+
+	owners := m.functionOwners()
+	for _, name := range m.order {
+		instance, ok := m.instances[name]
+		if !ok {
+			continue
+		}
+
+		for _, fn := range instance.plugin.Metadata.Functions {
+			f := &function{
+				name:     fn.Name,
+				instance: name,
+				log:      instance.log,
+				plugin:   instance.plugin,
+				breaker:  instance.breaker,
+				stats:    instance.stats,
+				timeout:  m.cfg.CallTimeout(&instance.config, fn.Name),
+				cache:    m.cfg.CacheSettings(&instance.config, &fn),
+
+				argsSchema: fn.ArgumentsSchema(),
+			}
+			snap.functions[qualifiedName(name, fn.Name)] = f
+			// bare names are only usable when they are unambiguous
+			if len(owners[fn.Name]) == 1 {
+				snap.functions[fn.Name] = f
+			} else {
+				snap.ambiguous[fn.Name] = append(snap.ambiguous[fn.Name], qualifiedName(name, fn.Name))
+			}
+		}
+		snap.instances = append(snap.instances, instance)
+	}
+
+	m.current.Store(snap)
+}
+
+// functionOwners returns the names of the plugins exposing each function,
+// it must be called with the mutex held
+func (m *Manager) functionOwners() map[string][]string {
+	owners := make(map[string][]string)
+	for _, name := range m.order {
+		instance, ok := m.instances[name]
+		if !ok {
+			continue
+		}
+
+		for _, fn := range instance.plugin.Metadata.Functions {
+			owners[fn.Name] = append(owners[fn.Name], name)
+		}
+	}
+
+	return owners
+}
+
+// checkCollisions reports the functions of a plugin that is about to be
+// registered which are already exposed by running plugins, it must be
+// called with the mutex held
+func (m *Manager) checkCollisions(instance *pluginInstance) error {
+	var errs error
+	owners := m.functionOwners()
+	for _, fn := range instance.plugin.Metadata.Functions {
+		if len(owners[fn.Name]) == 0 {
+			continue
+		}
+
+		names := append(owners[fn.Name], instance.name)
+		qualified := make([]string, 0, len(names))
+		for _, owner := range names {
+			qualified = append(qualified, qualifiedName(owner, fn.Name))
+		}
+
+		m.log.Warn(
+			fmt.Sprintf("function %s is registered by several plugins, call it as one of %s", fn.Name, strings.Join(qualified, ", ")),
+			zap.String("function", fn.Name),
+			zap.Strings("plugins", names),
+		)
+		errs = multierr.Append(errs, fmt.Errorf("function %s is registered by plugins %s", fn.Name, strings.Join(names, ", ")))
+	}
+
+	return errs
+}
+
+// qualifiedName returns the name under which a function is
+// always reachable, regardless of the other plugins loaded
+func qualifiedName(plugin string, function string) string {
+	return plugin + "." + function
+}
+
+func (m *Manager) startInstance(ctx context.Context, plgCfg config.ConfigPlugin, stats *pluginStats) (*pluginInstance, error) {
+	rawConfig, err := serialiseConfig(plgCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	storageDir := path.Join(paths.StateDir(), "storage")
+	if _, err := os.Stat(storageDir); os.IsNotExist(err) {
+		err = os.MkdirAll(storageDir, 0744)
+		if err != nil {
+			return nil, fmt.Errorf("could not create the storage directory: %w", err)
+		}
+	}
+
+	plgPath := path.Join(m.pluginsDir, plgCfg.PluginFile())
+	plgConfig := &plugins.PluginConfig{
+		UserHome:     m.homeDir,
+		GowerlineDir: paths.ConfigDir(),
+		StorageDir:   storageDir,
+		PluginName:   plgCfg.Name,
+		Config:       plgCfg.Config,
+		BoltDBPath:   path.Join(storageDir, fmt.Sprintf("%s.db", plgCfg.Name)),
+	}
+
+	instance := &pluginInstance{
+		name:      plgCfg.Name,
+		log:       m.logs.PluginLogger(plgCfg.Name),
+		config:    plgCfg,
+		rawConfig: rawConfig,
+		breaker:   newBreaker(),
+		stats:     stats,
+	}
+
+	switch plgCfg.Transport {
+	case "", config.TransportNative:
+		instance.db, err = plugins.OpenDB(ctx, plgConfig.BoltDBPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not create plugin database: %w", err)
+		}
+
+		// every instance gets its own registry so that a restarted
+		// plugin can register its collectors again
+		registry := prometheus.NewRegistry()
+		plgConfig.BoltDB = instance.db
+		plgConfig.Metrics = prometheus.WrapRegistererWith(prometheus.Labels{"plugin": plgCfg.Name}, registry)
+		instance.gatherer = registry
+		instance.plugin, err = m.newPlugin(ctx, instance.log, plgPath, plgConfig)
+	case config.TransportGRPC:
+		// the plugin process opens its own database and metrics registry
+		instance.plugin, err = plugins.NewGRPCPlugin(ctx, instance.log, plgPath, plgConfig, m.logs.Output())
+		if err == nil {
+			instance.gatherer = instance.plugin.Gatherer()
+		}
+	default:
+		err = fmt.Errorf("unknown transport %s", plgCfg.Transport)
+	}
+	if err != nil {
+		instance.close()
+		return nil, err
+	}
+
+	if err := validateConfig(plgCfg, instance.plugin.Metadata.ConfigSchema); err != nil {
+		instance.plugin.Close()
+		instance.close()
+		return nil, err
+	}
+
+	startData, err := instance.plugin.RunStart(ctx, instance.log)
+	if err != nil {
+		instance.plugin.Close()
+		instance.close()
+		return nil, err
+	}
+
+	if startData.Metadata.ConfigSchema == nil {
+		startData.Metadata.ConfigSchema = instance.plugin.Metadata.ConfigSchema
+	}
+	instance.plugin.Metadata = startData.Metadata
+
+	m.log.Info(
+		"loaded plugin",
+		zap.String("plugin", plgCfg.Name),
+		zap.String("plugin_file", plgCfg.PluginFile()),
+		zap.String("transport", plgCfg.Transport),
+		zap.String("version", startData.Metadata.Version),
+		zap.String("author", startData.Metadata.Author),
+	)
+
+	for _, fn := range startData.Metadata.Functions {
+		m.log.Info(
+			"registered new function for plugin",
+			zap.String("plugin", plgCfg.Name),
+			zap.String("function", fn.Name),
+		)
+	}
+
+	return instance, nil
+}
+
+// stopInstance stops a plugin, giving up on it when it does not stop in time,
+// and forgets about its results. It must no longer be registered, so that no
+// new result is cached for it.
+func (m *Manager) stopInstance(ctx context.Context, instance *pluginInstance) error {
+	err := m.releaseInstance(ctx, instance)
+	m.cache.Purge(instance.name)
+	m.lastResults.Purge(instance.name)
+	return err
+}
+
+// releaseInstance stops a plugin, giving up on it when it does not stop in time,
+// and closes its storage. The storage of a plugin that did not stop is left open
+// since it may still be writing to it, it is released when the server exits.
+func (m *Manager) releaseInstance(ctx context.Context, instance *pluginInstance) error {
+	m.log.Info("stopping plugin", zap.String("plugin", instance.name))
+
+	timeout := m.Config().StopTimeout()
+	returned, err := runBounded(ctx, timeout, func(ctx context.Context) error {
+		return instance.plugin.RunStop(ctx, instance.log)
+	}, nil)
+	if !returned {
+		err = fmt.Errorf("plugin did not stop within %s", timeout)
+		if instance.db != nil {
+			m.log.Warn(
+				"leaving the storage of the plugin open, it may still be using it",
+				zap.String("plugin", instance.name),
+				zap.String("database", instance.db.Path()),
+			)
+		}
+	} else {
+		instance.close()
+	}
+	instance.stats.Stopped(nil)
+	if err != nil {
+		m.log.Error("failed to stop plugin", zap.String("plugin", instance.name), zap.Error(err))
+		return fmt.Errorf("could not stop plugin %s: %w", instance.name, err)
+	}
+
+	return nil
+}
+
+func (i *pluginInstance) close() {
+	if i.db != nil {
+		i.db.Close()
+		i.db = nil
+	}
+}
+
+// serialiseConfig returns a canonical representation of the bits of
+// a plugin configuration that require a restart when they change
+func serialiseConfig(plgCfg config.ConfigPlugin) ([]byte, error) {
+	raw := []byte(plgCfg.PluginFile() + "\n" + plgCfg.Transport + "\n")
+	if plgCfg.Config.Kind == 0 {
+		return raw, nil
+	}
+
+	// Go through a generic value so that comments and
+	// formatting do not count as changes
+	var value interface{}
+	if err := plgCfg.Config.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	b, err := yaml.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(raw, b...), nil
+}
@@ -0,0 +1,329 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/logging"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// stubs builds the plugins of the tests in place of the plugin files, and
+// records the instances that were started and stopped
+type stubs struct {
+	mutex   *sync.Mutex
+	plugins map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin
+	started []string
+	stopped []string
+}
+
+func (s *stubs) newPlugin(ctx context.Context, log *zap.Logger, filePath string, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) {
+	build, ok := s.plugins[path.Base(filePath)]
+	if !ok {
+		return nil, fmt.Errorf("no such plugin %s", filePath)
+	}
+
+	plg := build(pCfg)
+	start, stop := plg.Start, plg.Stop
+	plg.Start = func(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+		s.record(&s.started, pCfg.PluginName)
+		return start(ctx, log)
+	}
+	plg.Stop = func(ctx context.Context, log *zap.Logger) error {
+		s.record(&s.stopped, pCfg.PluginName)
+		if stop != nil {
+			return stop(ctx, log)
+		}
+		return nil
+	}
+	return plg, nil
+}
+
+func (s *stubs) record(events *[]string, name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*events = append(*events, name)
+}
+
+// reset returns the instances started and stopped so far, sorted, and forgets about them
+func (s *stubs) reset() (started []string, stopped []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	started, stopped = s.started, s.stopped
+	s.started, s.stopped = nil, nil
+	sort.Strings(started)
+	sort.Strings(stopped)
+	return started, stopped
+}
+
+// stubPlugin is a plugin exposing the given functions, which render
+// as the name of the instance followed by the name of the function
+func stubPlugin(functions ...string) func(pCfg *plugins.PluginConfig) *plugins.Plugin {
+	return func(pCfg *plugins.PluginConfig) *plugins.Plugin {
+		descriptors := make([]types.FunctionDescriptor, 0, len(functions))
+		for _, fn := range functions {
+			descriptors = append(descriptors, types.FunctionDescriptor{Name: fn})
+		}
+
+		return &plugins.Plugin{
+			Name: pCfg.PluginName,
+			Start: func(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+				return &types.PluginStartData{Metadata: types.PluginMetadata{Functions: descriptors}}, nil
+			},
+			Call: func(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+				return result(qualifiedName(pCfg.PluginName, payload.Function)), nil
+			},
+		}
+	}
+}
+
+// newTestManager returns a manager loading the stubs, with its state in a temporary directory
+func newTestManager(t *testing.T, plugins map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin) (*Manager, *stubs) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	logs, err := logging.New(config.ConfigLog{Level: "fatal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubs{mutex: &sync.Mutex{}, plugins: plugins}
+	m := NewManager(logs, "gowerline.yaml", t.TempDir(), t.TempDir())
+	m.newPlugin = s.newPlugin
+	t.Cleanup(func() {
+		_ = m.StopAll(context.Background())
+	})
+
+	return m, s
+}
+
+// testConfig returns a configuration with the given plugins, that logs nothing but fatal errors
+func testConfig(plgCfgs ...config.ConfigPlugin) *config.Config {
+	return &config.Config{
+		Log:     config.ConfigLog{Level: "fatal"},
+		Plugins: plgCfgs,
+	}
+}
+
+// pluginEntry returns the entry of a plugin with the given yaml as its `config`
+func pluginEntry(t *testing.T, name string, plugin string, cfg string) config.ConfigPlugin {
+	t.Helper()
+	plgCfg := config.ConfigPlugin{Name: name, Plugin: plugin}
+	if cfg != "" {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(cfg), &doc); err != nil {
+			t.Fatal(err)
+		}
+		plgCfg.Config = *doc.Content[0]
+	}
+	return plgCfg
+}
+
+func result(content string) []*types.PowerlineReturn {
+	return []*types.PowerlineReturn{{Content: content}}
+}
+
+func content(result []*types.PowerlineReturn) string {
+	if len(result) == 0 {
+		return ""
+	}
+	return result[0].Content
+}
+
+func running(m *Manager) []string {
+	names := make([]string, 0)
+	for _, instance := range m.load().instances {
+		names = append(names, instance.name)
+	}
+	return names
+}
+
+func call(m *Manager, function string) (string, error) {
+	result, err := m.Call(context.Background(), zap.NewNop(), &types.Payload{Function: function})
+	return content(result), err
+}
+
+func TestApply(t *testing.T) {
+	m, s := newTestManager(t, map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin{
+		"time": stubPlugin("time"),
+		"bash": stubPlugin("hello"),
+	})
+
+	disabled := pluginEntry(t, "bash", "bash", "cmd: echo hello")
+	disabled.Disabled = true
+	lazy := pluginEntry(t, "bash", "bash", "cmd: echo hello")
+	lazy.Lazy = true
+
+	// the steps are applied in order, each one to the plugins left by the previous one
+	steps := []struct {
+		name    string
+		plugins []config.ConfigPlugin
+		running []string
+		started []string
+		stopped []string
+		// err is part of the error Apply is expected to return
+		err string
+	}{
+		{
+			name:    "initial configuration",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "time", "", ""), pluginEntry(t, "bash", "bash", "cmd: echo hi")},
+			running: []string{"time", "bash"},
+			started: []string{"bash", "time"},
+		},
+		{
+			name:    "unchanged",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "time", "", ""), pluginEntry(t, "bash", "bash", "cmd:   echo hi # formatting")},
+			running: []string{"time", "bash"},
+		},
+		{
+			name:    "reordered",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "bash", "bash", "cmd: echo hi"), pluginEntry(t, "time", "", "")},
+			running: []string{"bash", "time"},
+		},
+		{
+			name:    "reconfigured",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "bash", "bash", "cmd: echo hello"), pluginEntry(t, "time", "", "")},
+			running: []string{"bash", "time"},
+			started: []string{"bash"},
+			stopped: []string{"bash"},
+		},
+		{
+			name:    "duplicate ignored",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "bash", "bash", "cmd: echo hello"), pluginEntry(t, "time", "", ""), pluginEntry(t, "time", "", "format: '%H'")},
+			running: []string{"bash", "time"},
+		},
+		{
+			name:    "removed",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "bash", "bash", "cmd: echo hello")},
+			running: []string{"bash"},
+			stopped: []string{"time"},
+		},
+		{
+			name:    "disabled",
+			plugins: []config.ConfigPlugin{disabled, pluginEntry(t, "time", "", "")},
+			running: []string{"time"},
+			started: []string{"time"},
+			stopped: []string{"bash"},
+		},
+		{
+			name:    "lazy",
+			plugins: []config.ConfigPlugin{lazy, pluginEntry(t, "time", "", "")},
+			running: []string{"time"},
+		},
+		{
+			name:    "unknown plugin",
+			plugins: []config.ConfigPlugin{pluginEntry(t, "time", "", ""), pluginEntry(t, "network", "", "")},
+			running: []string{"time"},
+			err:     "could not load plugin network",
+		},
+	}
+
+	for _, step := range steps {
+		err := m.Apply(context.Background(), testConfig(step.plugins...))
+		if step.err != "" {
+			if err == nil || !strings.Contains(err.Error(), step.err) {
+				t.Fatalf("%s: expected error %q, got %v", step.name, step.err, err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.name, err)
+		}
+
+		if got := running(m); !reflect.DeepEqual(got, step.running) {
+			t.Errorf("%s: expected %v to be running, got %v", step.name, step.running, got)
+		}
+		started, stopped := s.reset()
+		if !reflect.DeepEqual(started, step.started) {
+			t.Errorf("%s: expected %v to be started, got %v", step.name, step.started, started)
+		}
+		if !reflect.DeepEqual(stopped, step.stopped) {
+			t.Errorf("%s: expected %v to be stopped, got %v", step.name, step.stopped, stopped)
+		}
+	}
+}
+
+func TestApplyCollisions(t *testing.T) {
+	tests := []struct {
+		name   string
+		strict bool
+		// calls maps the functions called to what they render, or to their error
+		calls map[string]string
+	}{
+		{
+			name: "ambiguous bare names",
+			calls: map[string]string{
+				"time":      "ambiguous function time, use one of time.time, utc.time",
+				"time.time": "time.time",
+				"utc.time":  "utc.time",
+				"date":      "time.date",
+				"zone":      "utc.zone",
+			},
+		},
+		{
+			name:   "strict functions",
+			strict: true,
+			calls: map[string]string{
+				"time":      "time.time",
+				"time.time": "time.time",
+				"utc.time":  "no such function utc.time",
+				"date":      "time.date",
+				"zone":      "no such function zone",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, _ := newTestManager(t, map[string]func(pCfg *plugins.PluginConfig) *plugins.Plugin{
+				"time": stubPlugin("time", "date"),
+				"utc":  stubPlugin("time", "zone"),
+			})
+
+			cfg := testConfig(pluginEntry(t, "time", "", ""))
+			cfg.StrictFunctions = test.strict
+			if err := m.Apply(context.Background(), cfg); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cfg = testConfig(pluginEntry(t, "time", "", ""), pluginEntry(t, "utc", "", ""))
+			cfg.StrictFunctions = test.strict
+			err := m.Apply(context.Background(), cfg)
+			if test.strict {
+				if err == nil || !strings.Contains(err.Error(), "function time is registered by plugins time, utc") {
+					t.Fatalf("expected the plugin to be refused, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("expected the collision to only be logged, got %s", err)
+			}
+
+			for function, want := range test.calls {
+				got, err := call(m, function)
+				if err != nil {
+					got = err.Error()
+				}
+				if got != want {
+					t.Errorf("expected %s to render %q, got %q", function, want, got)
+				}
+			}
+
+			var wantErr error = ErrAmbiguousFunction
+			if test.strict {
+				wantErr = nil
+			}
+			if _, err := call(m, "time"); !errors.Is(err, wantErr) {
+				t.Errorf("expected error %v, got %v", wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+const metricsNamespace = "gowerline"
+
+// Outcome of the requests made to the functions
+const (
+	requestStatusOK      = "ok"
+	requestStatusError   = "error"
+	requestStatusTimeout = "timeout"
+)
+
+// Reasons for which the calls to a plugin failed
+const (
+	pluginErrorError    = "error"
+	pluginErrorTimeout  = "timeout"
+	pluginErrorRejected = "rejected"
+)
+
+// Outcome of the lookups of the response cache
+const (
+	cacheResultHit   = "hit"
+	cacheResultStale = "stale"
+	cacheResultMiss  = "miss"
+)
+
+// pluginStates are the states exported for every plugin, all of them
+// so that the gauge of the previous state drops to 0 when it changes
+var pluginStates = []string{
+	types.PluginStateIdle,
+	types.PluginStateStarting,
+	types.PluginStateRunning,
+	types.PluginStateDegraded,
+	types.PluginStateStopped,
+	types.PluginStateDisabled,
+}
+
+// metrics are the series the server exposes about itself, the ones
+// registered by the plugins live in a registry per plugin instance
+type metrics struct {
+	registry     *prometheus.Registry
+	requests     *prometheus.CounterVec
+	duration     *prometheus.HistogramVec
+	pluginErrors *prometheus.CounterVec
+	cache        *prometheus.CounterVec
+}
+
+func newMetrics(m *Manager) *metrics {
+	mtr := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Number of segments rendered, by function and outcome.",
+		}, []string{"plugin", "function", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to render a segment, cache hits included.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"plugin", "function"}),
+		pluginErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "plugin_errors_total",
+			Help:      "Number of failed plugin calls, by reason.",
+		}, []string{"plugin", "reason"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cache_requests_total",
+			Help:      "Number of lookups of the response cache, by result.",
+		}, []string{"plugin", "function", "result"}),
+	}
+
+	mtr.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		mtr.requests,
+		mtr.duration,
+		mtr.pluginErrors,
+		mtr.cache,
+		&stateCollector{manager: m},
+	)
+
+	return mtr
+}
+
+func (mtr *metrics) Request(fn *function, status string, start time.Time) {
+	mtr.requests.WithLabelValues(fn.instance, fn.name, status).Inc()
+	mtr.duration.WithLabelValues(fn.instance, fn.name).Observe(time.Since(start).Seconds())
+}
+
+func (mtr *metrics) PluginError(fn *function, reason string) {
+	mtr.pluginErrors.WithLabelValues(fn.instance, reason).Inc()
+}
+
+func (mtr *metrics) Cache(fn *function, result string) {
+	mtr.cache.WithLabelValues(fn.instance, fn.name, result).Inc()
+}
+
+// stateCollector exposes the state of every configured plugin
+type stateCollector struct {
+	manager *Manager
+}
+
+var pluginStateDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "", "plugin_state"),
+	"State of the configured plugins, 1 for the current state of the plugin.",
+	[]string{"plugin", "state"},
+	nil,
+)
+
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pluginStateDesc
+}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	for name, status := range c.manager.Status(ctx) {
+		for _, state := range pluginStates {
+			value := 0.0
+			if status.State == state {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(pluginStateDesc, prometheus.GaugeValue, value, name, state)
+		}
+	}
+}
+
+// Gatherer returns the metrics of the server along with
+// the ones registered by the running plugins
+func (m *Manager) Gatherer() prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gatherers := prometheus.Gatherers{m.metrics.registry}
+		for _, instance := range m.load().instances {
+			if instance.gatherer != nil {
+				gatherers = append(gatherers, instance.gatherer)
+			}
+		}
+		return gatherers.Gather()
+	})
+}
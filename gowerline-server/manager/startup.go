@@ -0,0 +1,197 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+// crashRestartUptime is how long an out of process plugin must have run
+// for it to be started again when its process crashes
+const crashRestartUptime = time.Minute
+
+// errPluginExited is reported for the out of process plugins whose process crashed
+var errPluginExited = errors.New("plugin process exited unexpectedly")
+
+// pendingStart is a plugin that is not running yet. A start is discarded
+// when its pendingStart is no longer the one registered for the plugin,
+// which happens when the plugin is reconfigured or removed meanwhile.
+type pendingStart struct {
+	config    config.ConfigPlugin
+	rawConfig []byte
+	stats     *pluginStats
+	// started is set once the start of the plugin has been triggered
+	started bool
+}
+
+// runStart starts a pending plugin and registers it
+func (m *Manager) runStart(ctx context.Context, name string, pending *pendingStart) error {
+	m.mutex.Lock()
+	timeout := m.cfg.StartupSettings().Timeout
+	m.mutex.Unlock()
+
+	instance, err := m.startWithTimeout(ctx, pending.config, pending.stats, timeout)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.pending[name] != pending {
+		if instance != nil {
+			m.log.Info("plugin was reconfigured while starting, discarding it", zap.String("plugin", name))
+			_ = m.stopInstance(ctx, instance)
+		}
+		return nil
+	}
+	delete(m.pending, name)
+
+	if err == nil {
+		err = m.checkCollisions(instance)
+		if err != nil && m.cfg.StrictFunctions {
+			_ = m.stopInstance(ctx, instance)
+		} else {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		// the plugins may quote their configuration in their errors
+		err = m.cfg.Redact(err)
+		m.log.Error("could not load plugin", zap.String("plugin", name), zap.Error(err))
+		pending.stats.Stopped(err)
+		m.swap()
+		return fmt.Errorf("could not load plugin %s: %w", name, err)
+	}
+
+	pending.stats.SetState(types.PluginStateRunning)
+	instance.started = time.Now()
+	m.instances[name] = instance
+	m.swap()
+	m.watchExit(instance)
+
+	return nil
+}
+
+// watchExit notices when the process of a plugin running out of process exits while
+// the plugin is registered, which means it crashed since the plugins are unregistered
+// before being stopped. The plugin is started again unless it crashed soon after
+// starting, in which case it is reported as stopped until it is restarted by hand.
+func (m *Manager) watchExit(instance *pluginInstance) {
+	exited := instance.plugin.Exited()
+	if exited == nil {
+		return
+	}
+
+	go func() {
+		<-exited
+
+		m.mutex.Lock()
+		if m.instances[instance.name] != instance {
+			m.mutex.Unlock()
+			return
+		}
+
+		crashLoop := time.Since(instance.started) < crashRestartUptime
+		m.log.Error(
+			"plugin process exited unexpectedly",
+			zap.String("plugin", instance.name),
+			zap.Bool("restart", !crashLoop),
+		)
+		delete(m.instances, instance.name)
+		m.swap()
+		_ = m.stopInstance(context.Background(), instance)
+		instance.stats.Stopped(errPluginExited)
+
+		if crashLoop {
+			m.mutex.Unlock()
+			return
+		}
+		if err := m.startPlugin(context.Background(), instance.name, instance.config); err != nil {
+			m.log.Error("could not restart the plugin", zap.String("plugin", instance.name), zap.Error(err))
+		}
+	}()
+}
+
+// startWithTimeout gives up on a plugin that does not start in time,
+// it is stopped if it eventually manages to start
+func (m *Manager) startWithTimeout(ctx context.Context, plgCfg config.ConfigPlugin, stats *pluginStats, timeout time.Duration) (*pluginInstance, error) {
+	var instance *pluginInstance
+	returned, err := runBounded(ctx, timeout, func(ctx context.Context) error {
+		var err error
+		instance, err = m.startInstance(ctx, plgCfg, stats)
+		return err
+	}, func() {
+		if instance != nil {
+			m.log.Warn("plugin started after its startup timeout, stopping it", zap.String("plugin", plgCfg.Name))
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			_ = m.stopInstance(context.Background(), instance)
+		}
+	})
+	if !returned {
+		return nil, fmt.Errorf("plugin did not start within %s", timeout)
+	}
+
+	return instance, err
+}
+
+// startLazy starts a lazy plugin in the background, if it was not already
+func (m *Manager) startLazy(name string) {
+	go func() {
+		m.mutex.Lock()
+		pending, ok := m.pending[name]
+		if !ok || pending.started {
+			m.mutex.Unlock()
+			return
+		}
+		pending.started = true
+		pending.stats.SetState(types.PluginStateStarting)
+		m.mutex.Unlock()
+
+		m.log.Info("starting lazy plugin on first use", zap.String("plugin", name))
+		_ = m.runStart(context.Background(), name, pending)
+	}()
+}
+
+// isPending tells whether a call to an unknown function might succeed once the
+// plugins that are not running yet are started, starting the lazy ones if needed.
+// A qualified name only concerns its plugin, and a bare name the plugins declaring
+// it in their configuration. Any other bare name might belong to the plugins being
+// started along with the server, but never starts a lazy plugin.
+func (m *Manager) isPending(snap *snapshot, function string) bool {
+	if len(snap.pending) == 0 {
+		return false
+	}
+
+	if idx := strings.Index(function, "."); idx > 0 {
+		instance := function[:idx]
+		if !snap.pending[instance] {
+			return false
+		}
+		m.startLazy(instance)
+		return true
+	}
+
+	if instances, ok := snap.pendingFunctions[function]; ok {
+		for _, instance := range instances {
+			m.startLazy(instance)
+		}
+		return true
+	}
+	return snap.starting
+}
+
+// loading returns what to render in place of the segments of a plugin that is starting
+func (m *Manager) loading(snap *snapshot) []*types.PowerlineReturn {
+	return []*types.PowerlineReturn{
+		{
+			Content:        snap.startup.Placeholder,
+			HighlightGroup: []string{"gwl:loading", "information:regular"},
+		},
+	}
+}
@@ -0,0 +1,62 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+)
+
+// ErrInvalidArguments is returned when the arguments of a call do not match the schema of the function
+var ErrInvalidArguments = errors.New("invalid arguments")
+
+// validateConfig checks the configuration of a plugin against the schema it
+// declared, errors are reported with the name of the plugin instance as root
+func validateConfig(plgCfg config.ConfigPlugin, schema *types.Schema) error {
+	if schema == nil {
+		return nil
+	}
+
+	var value interface{}
+	if plgCfg.Config.Kind != 0 {
+		if err := plgCfg.Config.Decode(&value); err != nil {
+			return fmt.Errorf("could not decode the configuration of %s: %w", plgCfg.Name, err)
+		}
+	}
+	// a missing configuration is an empty one
+	if value == nil && schema.Type == types.SchemaTypeObject {
+		value = map[string]interface{}{}
+	}
+
+	if err := schema.Validate(plgCfg.Name, value); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return nil
+}
+
+// validateArgs checks the arguments of a call against the schema of the function
+func validateArgs(fn *function, payload *types.Payload) error {
+	if fn.argsSchema == nil {
+		return nil
+	}
+
+	var value interface{}
+	if payload.Args != nil {
+		if err := json.Unmarshal(*payload.Args, &value); err != nil {
+			return fmt.Errorf("%w for %s: %s", ErrInvalidArguments, payload.Function, err)
+		}
+	}
+	// no arguments is the same as empty ones
+	if value == nil && fn.argsSchema.Type == types.SchemaTypeObject {
+		value = map[string]interface{}{}
+	}
+
+	if err := fn.argsSchema.Validate("args", value); err != nil {
+		return fmt.Errorf("%w for %s: %s", ErrInvalidArguments, payload.Function, err)
+	}
+
+	return nil
+}
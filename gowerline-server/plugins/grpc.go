@@ -0,0 +1,174 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// The out of process plugins talk to the server over gRPC. To avoid having to
+// ship protobuf definitions and generated code, the messages are plain Go structs
+// that are marshalled as JSON by a custom gRPC codec.
+const (
+	grpcServiceName = "gowerline.Plugin"
+	grpcCodecName   = "json"
+
+	// envMagicCookie is set by the server when spawning a plugin, it is only
+	// used to make sure the plugin binary is not being ran by hand
+	envMagicCookie   = "GOWERLINE_PLUGIN_MAGIC_COOKIE"
+	magicCookieValue = "b3a1c0a6d5e94f2e9b1d0c8f6a7e4d21"
+	// envPluginSocket holds the path to the unix socket the plugin must listen on
+	envPluginSocket = "GOWERLINE_PLUGIN_SOCKET"
+	// handshakeLine is printed by the plugin on its stdout once it is
+	// ready to accept connections
+	handshakeLine = "gowerline-plugin|1|ready"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return grpcCodecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type grpcEmpty struct{}
+
+// grpcInitRequest carries the PluginConfig over the wire, the
+// BoltDB itself is opened by the plugin process
+type grpcInitRequest struct {
+	UserHome     string `json:"user_home"`
+	GowerlineDir string `json:"gowerline_dir"`
+	PluginName   string `json:"plugin_name"`
+	StorageDir   string `json:"storage_dir"`
+	BoltDBPath   string `json:"bolt_db_path"`
+	// Config is the yaml encoded plugin configuration
+	Config []byte `json:"config"`
+	// LogLevel is the level the plugin logs at
+	LogLevel string `json:"log_level"`
+}
+
+// grpcLogLevelRequest changes the level the plugin logs at
+type grpcLogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type grpcInitResponse struct {
+	Name         string        `json:"name"`
+	ConfigSchema *types.Schema `json:"config_schema,omitempty"`
+}
+
+// grpcHealthResponse has a nil Health when the
+// plugin does not implement the Health hook
+type grpcHealthResponse struct {
+	Health *types.PluginHealth `json:"health"`
+}
+
+// grpcMetricsResponse holds the metric families gathered
+// by the plugin, in the delimited protobuf format
+type grpcMetricsResponse struct {
+	Metrics []byte `json:"metrics"`
+}
+
+type grpcCallResponse struct {
+	Returns []*types.PowerlineReturn `json:"returns"`
+}
+
+// grpcPluginServer is implemented by the plugin process
+type grpcPluginServer interface {
+	Init(context.Context, *grpcInitRequest) (*grpcInitResponse, error)
+	Start(context.Context, *grpcEmpty) (*types.PluginStartData, error)
+	Stop(context.Context, *grpcEmpty) (*grpcEmpty, error)
+	Call(context.Context, *types.Payload) (*grpcCallResponse, error)
+	Health(context.Context, *grpcEmpty) (*grpcHealthResponse, error)
+	Metrics(context.Context, *grpcEmpty) (*grpcMetricsResponse, error)
+	SetLogLevel(context.Context, *grpcLogLevelRequest) (*grpcEmpty, error)
+}
+
+func grpcInitHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcInitRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Init(ctx, &req)
+}
+
+func grpcStartHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcEmpty
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Start(ctx, &req)
+}
+
+func grpcStopHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcEmpty
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Stop(ctx, &req)
+}
+
+func grpcCallHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req types.Payload
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Call(ctx, &req)
+}
+
+func grpcHealthHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcEmpty
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Health(ctx, &req)
+}
+
+func grpcMetricsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcEmpty
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).Metrics(ctx, &req)
+}
+
+func grpcSetLogLevelHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req grpcLogLevelRequest
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	return srv.(grpcPluginServer).SetLogLevel(ctx, &req)
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*grpcPluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Init", Handler: grpcInitHandler},
+		{MethodName: "Start", Handler: grpcStartHandler},
+		{MethodName: "Stop", Handler: grpcStopHandler},
+		{MethodName: "Call", Handler: grpcCallHandler},
+		{MethodName: "Health", Handler: grpcHealthHandler},
+		{MethodName: "Metrics", Handler: grpcMetricsHandler},
+		{MethodName: "SetLogLevel", Handler: grpcSetLogLevelHandler},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+func grpcMethod(name string) string {
+	return "/" + grpcServiceName + "/" + name
+}
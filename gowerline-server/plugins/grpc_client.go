@@ -0,0 +1,283 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	grpcHandshakeTimeout = 10 * time.Second
+	grpcExitTimeout      = 5 * time.Second
+	grpcMetricsTimeout   = time.Second
+)
+
+// grpcPluginClient drives a plugin that runs in a child process
+type grpcPluginClient struct {
+	cmd       *exec.Cmd
+	conn      *grpc.ClientConn
+	stdin     io.WriteCloser
+	socketDir string
+	exited    chan struct{}
+}
+
+// NewGRPCPlugin spawns the plugin binary located at filePath as a child process
+// and returns a Plugin that proxies every Start/Stop/Call to it over gRPC. The
+// plugin logs at the level of log, and its output goes to output.
+func NewGRPCPlugin(ctx context.Context, log *zap.Logger, filePath string, pluginConfig *PluginConfig, output io.Writer) (*Plugin, error) {
+	log = log.With(zap.String("plugin_path", filePath))
+
+	socketDir, err := ioutil.TempDir("", "gowerline-plugin-")
+	if err != nil {
+		return nil, err
+	}
+	socketPath := path.Join(socketDir, "plugin.sock")
+
+	client := &grpcPluginClient{
+		socketDir: socketDir,
+		exited:    make(chan struct{}),
+	}
+
+	client.cmd = exec.Command(filePath)
+	client.cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%s", envMagicCookie, magicCookieValue),
+		fmt.Sprintf("%s=%s", envPluginSocket, socketPath),
+	)
+	client.cmd.Stderr = output
+	// Do not forward the terminal's signals to the plugin, the server
+	// is in charge of stopping it
+	client.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, err := client.cmd.StdoutPipe()
+	if err != nil {
+		client.cleanup()
+		return nil, err
+	}
+
+	// The plugin exits on its own when its stdin is closed, so
+	// that it does not outlive the server if it crashes
+	client.stdin, err = client.cmd.StdinPipe()
+	if err != nil {
+		client.cleanup()
+		return nil, err
+	}
+
+	if err := client.cmd.Start(); err != nil {
+		client.cleanup()
+		return nil, err
+	}
+
+	go func() {
+		err := client.cmd.Wait()
+		if err != nil {
+			log.Warn("plugin process exited", zap.Error(err))
+		} else {
+			log.Info("plugin process exited")
+		}
+		close(client.exited)
+	}()
+
+	if err := client.handshake(log, stdout); err != nil {
+		client.kill()
+		return nil, err
+	}
+
+	client.conn, err = grpc.Dial(
+		"unix://"+socketPath,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(grpcCodecName)),
+	)
+	if err != nil {
+		client.kill()
+		return nil, err
+	}
+
+	req := &grpcInitRequest{
+		UserHome:     pluginConfig.UserHome,
+		GowerlineDir: pluginConfig.GowerlineDir,
+		PluginName:   pluginConfig.PluginName,
+		StorageDir:   pluginConfig.StorageDir,
+		BoltDBPath:   pluginConfig.BoltDBPath,
+		LogLevel:     zapcore.LevelOf(log.Core()).String(),
+	}
+	if pluginConfig.Config.Kind != 0 {
+		req.Config, err = yaml.Marshal(&pluginConfig.Config)
+		if err != nil {
+			client.kill()
+			return nil, err
+		}
+	}
+
+	var resp grpcInitResponse
+	err = client.conn.Invoke(ctx, grpcMethod("Init"), req, &resp)
+	if err != nil {
+		client.kill()
+		return nil, fmt.Errorf("could not initialise plugin: %w", err)
+	}
+
+	name := resp.Name
+	if name == "" {
+		name = pluginConfig.PluginName
+	}
+
+	return &Plugin{
+		Start:    client.start,
+		Stop:     client.stop,
+		Call:     client.call,
+		Health:   client.health,
+		Name:     name,
+		Metadata: types.PluginMetadata{ConfigSchema: resp.ConfigSchema},
+		gatherer: prometheus.GathererFunc(client.gather),
+		close:    client.kill,
+
+		setLogLevel: client.setLogLevel,
+		exited:      client.exited,
+	}, nil
+}
+
+// handshake waits for the plugin to announce that it is listening, anything
+// it prints on its stdout afterwards goes to its logs
+func (c *grpcPluginClient) handshake(log *zap.Logger, stdout io.Reader) error {
+	lines := make(chan string, 1)
+	reader := bufio.NewReader(stdout)
+
+	go func() {
+		line, _ := reader.ReadString('\n')
+		lines <- strings.TrimSpace(line)
+		// Anything the plugin prints afterwards is not ours to interpret
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				log.Info("plugin output", zap.String("output", strings.TrimRight(line, "\n")))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case line := <-lines:
+		if line != handshakeLine {
+			return fmt.Errorf("unexpected handshake from plugin: %q", line)
+		}
+		return nil
+	case <-c.exited:
+		return fmt.Errorf("plugin exited before completing the handshake")
+	case <-time.After(grpcHandshakeTimeout):
+		return fmt.Errorf("timed out waiting for the plugin handshake")
+	}
+}
+
+func (c *grpcPluginClient) start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	var resp types.PluginStartData
+	err := c.conn.Invoke(ctx, grpcMethod("Start"), &grpcEmpty{}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *grpcPluginClient) stop(ctx context.Context, log *zap.Logger) error {
+	err := c.conn.Invoke(ctx, grpcMethod("Stop"), &grpcEmpty{}, &grpcEmpty{})
+	if err != nil {
+		log.Error("plugin failed to stop cleanly", zap.Error(err))
+	}
+
+	c.conn.Close()
+	c.stdin.Close()
+
+	select {
+	case <-c.exited:
+	case <-time.After(grpcExitTimeout):
+		log.Warn("plugin did not exit in time, killing it")
+		c.kill()
+	}
+
+	c.cleanup()
+	return err
+}
+
+func (c *grpcPluginClient) call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+	var resp grpcCallResponse
+	err := c.conn.Invoke(ctx, grpcMethod("Call"), payload, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Returns, nil
+}
+
+func (c *grpcPluginClient) health(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+	var resp grpcHealthResponse
+	err := c.conn.Invoke(ctx, grpcMethod("Health"), &grpcEmpty{}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Health, nil
+}
+
+func (c *grpcPluginClient) setLogLevel(ctx context.Context, level zapcore.Level) error {
+	return c.conn.Invoke(ctx, grpcMethod("SetLogLevel"), &grpcLogLevelRequest{Level: level.String()}, &grpcEmpty{})
+}
+
+// gather fetches the metrics the plugin registered in its own process
+func (c *grpcPluginClient) gather() ([]*dto.MetricFamily, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), grpcMetricsTimeout)
+	defer cancel()
+
+	var resp grpcMetricsResponse
+	err := c.conn.Invoke(ctx, grpcMethod("Metrics"), &grpcEmpty{}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	families := make([]*dto.MetricFamily, 0)
+	decoder := expfmt.NewDecoder(bytes.NewReader(resp.Metrics), expfmt.FmtProtoDelim)
+	for {
+		family := &dto.MetricFamily{}
+		err := decoder.Decode(family)
+		if errors.Is(err, io.EOF) {
+			return families, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, family)
+	}
+}
+
+func (c *grpcPluginClient) kill() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+		<-c.exited
+	}
+	c.cleanup()
+}
+
+func (c *grpcPluginClient) cleanup() {
+	os.RemoveAll(c.socketDir)
+}
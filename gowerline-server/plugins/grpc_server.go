@@ -0,0 +1,226 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v3"
+)
+
+// PluginInitFunc is the signature of the `Init` function every plugin exports
+type PluginInitFunc func(context.Context, *zap.Logger, *PluginConfig) (*Plugin, error)
+
+// grpcPluginService runs within the plugin process and
+// forwards the server's calls to the actual plugin
+type grpcPluginService struct {
+	log *zap.Logger
+	// level is the level of log, set by the server
+	level   zap.AtomicLevel
+	init    PluginInitFunc
+	plugin  *Plugin
+	db      *bolt.DB
+	metrics *prometheus.Registry
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// Serve is meant to be called from the `main` function of a plugin so that the
+// very same code can also be ran out of process with the `grpc` transport:
+//
+//	func main() {
+//		plugins.Serve(Init)
+//	}
+//
+// It never returns.
+func Serve(init PluginInitFunc) {
+	if os.Getenv(envMagicCookie) != magicCookieValue {
+		fmt.Fprintln(os.Stderr, "this binary is a gowerline plugin, it is meant to be started by the gowerline server")
+		os.Exit(1)
+	}
+	socket := os.Getenv(envPluginSocket)
+	// the commands the plugin runs must not see them
+	os.Unsetenv(envMagicCookie)
+	os.Unsetenv(envPluginSocket)
+
+	logConfig := zap.NewProductionConfig()
+	log, err := logConfig.Build()
+	if err != nil {
+		panic(err)
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatal("could not listen on the plugin socket", zap.Error(err))
+	}
+
+	service := &grpcPluginService{
+		log:     log,
+		level:   logConfig.Level,
+		init:    init,
+		stopped: make(chan struct{}),
+	}
+
+	server := grpc.NewServer()
+	server.RegisterService(&grpcServiceDesc, service)
+
+	go func() {
+		<-service.stopped
+		server.GracefulStop()
+	}()
+
+	// The server holds our stdin, if it goes away so do we
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, os.Stdin)
+		select {
+		case <-service.stopped:
+			// we are already on our way out
+		default:
+			log.Info("server went away, exiting")
+			server.Stop()
+		}
+	}()
+
+	fmt.Fprintln(os.Stdout, handshakeLine)
+
+	err = server.Serve(listener)
+	if err != nil {
+		log.Error("plugin server exited", zap.Error(err))
+	}
+
+	if service.db != nil {
+		service.db.Close()
+	}
+
+	os.Exit(0)
+}
+
+func (s *grpcPluginService) Init(ctx context.Context, req *grpcInitRequest) (resp *grpcInitResponse, err error) {
+	defer recoverPanic(s.log, "Init", &err)
+
+	if req.LogLevel != "" {
+		if _, err := s.SetLogLevel(ctx, &grpcLogLevelRequest{Level: req.LogLevel}); err != nil {
+			return nil, err
+		}
+	}
+
+	pluginConfig := &PluginConfig{
+		UserHome:     req.UserHome,
+		GowerlineDir: req.GowerlineDir,
+		PluginName:   req.PluginName,
+		StorageDir:   req.StorageDir,
+		BoltDBPath:   req.BoltDBPath,
+	}
+
+	s.metrics = prometheus.NewRegistry()
+	pluginConfig.Metrics = prometheus.WrapRegistererWith(prometheus.Labels{"plugin": req.PluginName}, s.metrics)
+
+	if len(req.Config) != 0 {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(req.Config, &doc); err != nil {
+			return nil, err
+		}
+		// Unwrap the document so plugins get the same node as the native transport
+		if doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+			pluginConfig.Config = *doc.Content[0]
+		} else {
+			pluginConfig.Config = doc
+		}
+	}
+
+	if req.BoltDBPath != "" {
+		s.db, err = OpenDB(ctx, req.BoltDBPath)
+		if err != nil {
+			return nil, err
+		}
+		pluginConfig.BoltDB = s.db
+	}
+
+	plg, err := s.init(ctx, s.log.With(zap.String("plugin_name", req.PluginName)), pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	s.plugin = plg
+
+	return &grpcInitResponse{Name: plg.Name, ConfigSchema: plg.Metadata.ConfigSchema}, nil
+}
+
+func (s *grpcPluginService) Start(ctx context.Context, _ *grpcEmpty) (*types.PluginStartData, error) {
+	if s.plugin == nil {
+		return nil, fmt.Errorf("plugin is not initialised")
+	}
+	return s.plugin.RunStart(ctx, s.log)
+}
+
+func (s *grpcPluginService) Stop(ctx context.Context, _ *grpcEmpty) (*grpcEmpty, error) {
+	defer s.once.Do(func() { close(s.stopped) })
+
+	if s.plugin == nil {
+		return &grpcEmpty{}, nil
+	}
+	return &grpcEmpty{}, s.plugin.RunStop(ctx, s.log)
+}
+
+func (s *grpcPluginService) Call(ctx context.Context, payload *types.Payload) (*grpcCallResponse, error) {
+	if s.plugin == nil {
+		return nil, fmt.Errorf("plugin is not initialised")
+	}
+	result, err := s.plugin.RunCall(ctx, s.log, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcCallResponse{Returns: result}, nil
+}
+
+func (s *grpcPluginService) Health(ctx context.Context, _ *grpcEmpty) (*grpcHealthResponse, error) {
+	if s.plugin == nil {
+		return nil, fmt.Errorf("plugin is not initialised")
+	}
+	health, err := s.plugin.RunHealth(ctx, s.log)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcHealthResponse{Health: health}, nil
+}
+
+func (s *grpcPluginService) SetLogLevel(ctx context.Context, req *grpcLogLevelRequest) (*grpcEmpty, error) {
+	level, err := zapcore.ParseLevel(req.Level)
+	if err != nil {
+		return nil, err
+	}
+	s.level.SetLevel(level)
+	return &grpcEmpty{}, nil
+}
+
+func (s *grpcPluginService) Metrics(ctx context.Context, _ *grpcEmpty) (*grpcMetricsResponse, error) {
+	if s.metrics == nil {
+		return &grpcMetricsResponse{}, nil
+	}
+
+	families, err := s.metrics.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtProtoDelim)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return nil, err
+		}
+	}
+
+	return &grpcMetricsResponse{Metrics: buf.Bytes()}, nil
+}
@@ -0,0 +1,53 @@
+package plugins
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+)
+
+// HealthTracker records the outcome of the background refreshes of a plugin.
+// Its Health method can be used as the Health hook of the plugin, which is
+// reported unhealthy until a refresh succeeds after a failed one.
+type HealthTracker struct {
+	mutex         sync.Mutex
+	lastError     error
+	lastErrorTime time.Time
+	lastRefresh   time.Time
+}
+
+// Success records a successful refresh
+func (h *HealthTracker) Success() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastRefresh = time.Now()
+}
+
+// Failure records a failed refresh
+func (h *HealthTracker) Failure(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastError = err
+	h.lastErrorTime = time.Now()
+}
+
+func (h *HealthTracker) Health(ctx context.Context, log *zap.Logger) (*types.PluginHealth, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	health := &types.PluginHealth{
+		Healthy: h.lastError == nil || h.lastRefresh.After(h.lastErrorTime),
+	}
+	if h.lastError != nil {
+		health.LastError = h.lastError.Error()
+	}
+	if !h.lastRefresh.IsZero() {
+		lastRefresh := h.lastRefresh
+		health.LastRefresh = &lastRefresh
+	}
+
+	return health, nil
+}
@@ -2,14 +2,23 @@ package plugins
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"plugin"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
 	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
 )
 
+// defaultOpenTimeout is how long the storage of a plugin is waited for when
+// the context has no deadline, another server may still be holding it
+const defaultOpenTimeout = 30 * time.Second
+
 // Called when a plugin starts, returns data such as the plugin name
 type PluginStartFunc func(context.Context, *zap.Logger) (*types.PluginStartData, error)
 
@@ -19,14 +28,27 @@ type PluginStopFunc func(context.Context, *zap.Logger) error
 // Called when we need to render a segment effectively
 type PluginCallFunc func(context.Context, *zap.Logger, *types.Payload) ([]*types.PowerlineReturn, error)
 
+// Called to find out whether the plugin works properly, it is optional
+type PluginHealthFunc func(context.Context, *zap.Logger) (*types.PluginHealth, error)
+
 // Plugin type
 type Plugin struct {
-	Start PluginStartFunc
-	Stop  PluginStopFunc
-	Call  PluginCallFunc
+	Start  PluginStartFunc
+	Stop   PluginStopFunc
+	Call   PluginCallFunc
+	Health PluginHealthFunc
 
 	Name     string
 	Metadata types.PluginMetadata
+
+	// gatherer collects the metrics of out of process plugins
+	gatherer prometheus.Gatherer
+	// close releases a plugin that was initialised but never started
+	close func()
+	// setLogLevel changes the level of the logs of out of process plugins
+	setLogLevel func(context.Context, zapcore.Level) error
+	// exited is closed when the process of an out of process plugin exits
+	exited <-chan struct{}
 }
 
 // PluginConfig will be passed down to plugins
@@ -37,6 +59,8 @@ type PluginConfig struct {
 	// BoltDB is used as a K/V cache for data for plugins that
 	// would need them. Careful though as it is not thread safe.
 	BoltDB *bolt.DB
+	// BoltDBPath is the path of the file backing BoltDB
+	BoltDBPath string
 	// StorageDir is the directory that would hold plugin specific data
 	// such as caches and what not. It will also hold the bolt databases
 	// that comes with all plugins by default.
@@ -44,9 +68,31 @@ type PluginConfig struct {
 	// Config is a yaml node containing the configuration that
 	// is specific to the plugin
 	Config yaml.Node
+	// Metrics is where the plugin registers its own prometheus collectors,
+	// they are exposed by the server with a `plugin` label set to PluginName
+	Metrics prometheus.Registerer
 }
 
-func NewPlugin(ctx context.Context, log *zap.Logger, filePath string, pluginConfig *PluginConfig) (*Plugin, error) {
+// OpenDB opens the bolt database of a plugin. Only one process may have it open, so it
+// waits for the one holding it, such as the server being upgraded, until the context
+// expires rather than forever.
+func OpenDB(ctx context.Context, path string) (*bolt.DB, error) {
+	timeout := defaultOpenTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: timeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is still in use after %s", path, timeout.Round(time.Millisecond))
+	}
+	return db, err
+}
+
+func NewPlugin(ctx context.Context, log *zap.Logger, filePath string, pluginConfig *PluginConfig) (plg *Plugin, err error) {
 	p, err := plugin.Open(filePath)
 	if err != nil {
 		return nil, err
@@ -57,22 +103,102 @@ func NewPlugin(ctx context.Context, log *zap.Logger, filePath string, pluginConf
 		return nil, err
 	}
 
-	init := sym.(func(context.Context, *zap.Logger, *PluginConfig) (*Plugin, error))
+	init, ok := sym.(func(context.Context, *zap.Logger, *PluginConfig) (*Plugin, error))
+	if !ok {
+		return nil, fmt.Errorf("unexpected signature for the Init function of %s", filePath)
+	}
 
-	return init(context.Background(), log.With(zap.String("plugin_path", filePath)), pluginConfig)
+	log = log.With(zap.String("plugin_path", filePath))
+	defer recoverPanic(log, "Init", &err)
+
+	return init(context.Background(), log, pluginConfig)
+}
+
+// recoverPanic turns a panic into an error so that a faulty
+// plugin does not take the whole server down with it
+func recoverPanic(log *zap.Logger, stage string, err *error) {
+	if r := recover(); r != nil {
+		log.Error("recovered from a plugin panic", zap.String("stage", stage), zap.Any("panic", r), zap.Stack("stack"))
+		*err = fmt.Errorf("plugin panicked in %s: %v", stage, r)
+	}
 }
 
-func (p *Plugin) RunStart(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	return p.Start(ctx, log.With(zap.String("plugin_name", p.Name)))
+// SafeGo runs fn in a goroutine, logging and swallowing any panic instead of
+// crashing the server. Plugins should use it for their background goroutines.
+func SafeGo(log *zap.Logger, fn func()) {
+	go func() {
+		var err error
+		defer func() {
+			if err != nil {
+				log.Error("plugin goroutine exited", zap.Error(err))
+			}
+		}()
+		defer recoverPanic(log, "goroutine", &err)
+
+		fn()
+	}()
+}
+
+func (p *Plugin) RunStart(ctx context.Context, log *zap.Logger) (data *types.PluginStartData, err error) {
+	log = log.With(zap.String("plugin_name", p.Name))
+	defer recoverPanic(log, "Start", &err)
+
+	return p.Start(ctx, log)
 }
 
-func (p *Plugin) RunStop(ctx context.Context, log *zap.Logger) error {
+func (p *Plugin) RunStop(ctx context.Context, log *zap.Logger) (err error) {
+	log = log.With(zap.String("plugin_name", p.Name))
+	defer recoverPanic(log, "Stop", &err)
+
 	if p.Stop != nil {
-		return p.Stop(ctx, log.With(zap.String("plugin_name", p.Name)))
+		return p.Stop(ctx, log)
 	}
 	return nil
 }
 
-func (p *Plugin) RunCall(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
-	return p.Call(ctx, log.With(zap.String("plugin_name", p.Name)), payload)
+func (p *Plugin) RunCall(ctx context.Context, log *zap.Logger, payload *types.Payload) (result []*types.PowerlineReturn, err error) {
+	log = log.With(zap.String("plugin_name", p.Name))
+	defer recoverPanic(log, "Call", &err)
+
+	return p.Call(ctx, log, payload)
+}
+
+// Gatherer returns the metrics of a plugin running out of process, it is nil
+// for native plugins whose metrics are gathered from PluginConfig.Metrics
+func (p *Plugin) Gatherer() prometheus.Gatherer {
+	return p.gatherer
+}
+
+// Close releases the resources of a plugin that was initialised but will
+// not be started, such as the process of an out of process plugin
+func (p *Plugin) Close() {
+	if p.close != nil {
+		p.close()
+	}
+}
+
+// SetLogLevel changes the level of the logs of a plugin running out of process, native
+// plugins log through the logger they are given which already follows the level
+func (p *Plugin) SetLogLevel(ctx context.Context, level zapcore.Level) error {
+	if p.setLogLevel != nil {
+		return p.setLogLevel(ctx, level)
+	}
+	return nil
+}
+
+// Exited is closed once the process of a plugin running out of process exits, whether
+// it was stopped or it crashed. It is nil for native plugins.
+func (p *Plugin) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// RunHealth returns nil when the plugin does not implement the Health hook
+func (p *Plugin) RunHealth(ctx context.Context, log *zap.Logger) (health *types.PluginHealth, err error) {
+	log = log.With(zap.String("plugin_name", p.Name))
+	defer recoverPanic(log, "Health", &err)
+
+	if p.Health != nil {
+		return p.Health(ctx, log)
+	}
+	return nil, nil
 }
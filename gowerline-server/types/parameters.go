@@ -0,0 +1,156 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParameterDescriptor describes one of the `args` of a function. Type is one of
+// the string, integer, number, boolean or array schema types, the values of parameters
+// without a type are not checked and are sent as strings by the command line. Arrays
+// are given on the command line as a JSON list, or as a comma separated list of strings.
+type ParameterDescriptor struct {
+	Name        string `json:"name" yaml:"name"`
+	Type        string `json:"type,omitempty" yaml:"type,omitempty"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty"`
+	Required    bool   `json:"required,omitempty" yaml:"required,omitempty"`
+	// Default is the value the plugin uses when the parameter is not set
+	Default interface{} `json:"default,omitempty" yaml:"default,omitempty"`
+	// Enum lists the values the parameter can take, if it is restricted
+	Enum []interface{} `json:"enum,omitempty" yaml:"enum,omitempty"`
+}
+
+// TypeName returns the type of the parameter, string when it is not set
+func (p *ParameterDescriptor) TypeName() string {
+	if p.Type == "" {
+		return SchemaTypeString
+	}
+	return p.Type
+}
+
+// Parse converts the string value of the parameter, as given on the
+// command line, to its type and checks it against the schema
+func (p *ParameterDescriptor) Parse(value string) (interface{}, error) {
+	var parsed interface{}
+	var err error
+	switch p.TypeName() {
+	case SchemaTypeBoolean:
+		parsed, err = strconv.ParseBool(value)
+	case SchemaTypeInteger:
+		parsed, err = strconv.ParseInt(value, 10, 64)
+	case SchemaTypeNumber:
+		parsed, err = strconv.ParseFloat(value, 64)
+	case SchemaTypeArray:
+		parsed, err = parseList(value)
+	default:
+		parsed = value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s must be %s", p.Name, p.schema().describe())
+	}
+
+	if err := p.schema().Validate(p.Name, parsed); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// parseList parses a JSON list, or a comma separated list of strings
+func parseList(value string) ([]interface{}, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var list []interface{}
+		err := json.Unmarshal([]byte(value), &list)
+		return list, err
+	}
+
+	list := make([]interface{}, 0)
+	if value == "" {
+		return list, nil
+	}
+	for _, item := range strings.Split(value, ",") {
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func (p *ParameterDescriptor) schema() *Schema {
+	return &Schema{
+		Type:        p.Type,
+		Description: p.Description,
+		Default:     p.Default,
+		Enum:        p.Enum,
+	}
+}
+
+// ArgumentsSchema returns the schema the arguments of the function are validated
+// against, the ArgsSchema when it is set or one built from the Parameters otherwise
+func (f *FunctionDescriptor) ArgumentsSchema() *Schema {
+	if f.ArgsSchema != nil || len(f.Parameters) == 0 {
+		return f.ArgsSchema
+	}
+
+	schema := &Schema{
+		Type:       SchemaTypeObject,
+		Properties: make(map[string]*Schema, len(f.Parameters)),
+	}
+	for idx := range f.Parameters {
+		param := &f.Parameters[idx]
+		schema.Properties[param.Name] = param.schema()
+		if param.Required {
+			schema.Required = append(schema.Required, param.Name)
+		}
+	}
+
+	return schema
+}
+
+// Parameter returns the descriptor of the named parameter, if the function has it
+func (f *FunctionDescriptor) Parameter(name string) (*ParameterDescriptor, bool) {
+	for idx := range f.Parameters {
+		if f.Parameters[idx].Name == name {
+			return &f.Parameters[idx], true
+		}
+	}
+	return nil, false
+}
+
+// UnmarshalJSON also accepts the parameters as a map of names to help texts,
+// which is what the plugins built against older servers send
+func (f *FunctionDescriptor) UnmarshalJSON(data []byte) error {
+	type functionDescriptor FunctionDescriptor
+	var raw struct {
+		*functionDescriptor
+		Parameters json.RawMessage `json:"parameters"`
+	}
+	raw.functionDescriptor = (*functionDescriptor)(f)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	f.Parameters = nil
+	params := strings.TrimSpace(string(raw.Parameters))
+	if params == "" || params == "null" {
+		return nil
+	}
+
+	if !strings.HasPrefix(params, "{") {
+		return json.Unmarshal(raw.Parameters, &f.Parameters)
+	}
+
+	var legacy map[string]string
+	if err := json.Unmarshal(raw.Parameters, &legacy); err != nil {
+		return err
+	}
+	for name, description := range legacy {
+		f.Parameters = append(f.Parameters, ParameterDescriptor{Name: name, Description: description})
+	}
+	sort.Slice(f.Parameters, func(i, j int) bool {
+		return f.Parameters[i].Name < f.Parameters[j].Name
+	})
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParameterParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		param ParameterDescriptor
+		value string
+		want  interface{}
+		err   string
+	}{
+		{
+			name:  "untyped",
+			param: ParameterDescriptor{Name: "cmd"},
+			value: "42",
+			want:  "42",
+		},
+		{
+			name:  "string",
+			param: ParameterDescriptor{Name: "cmd", Type: SchemaTypeString},
+			value: "date",
+			want:  "date",
+		},
+		{
+			name:  "integer",
+			param: ParameterDescriptor{Name: "count", Type: SchemaTypeInteger},
+			value: "-12",
+			want:  int64(-12),
+		},
+		{
+			name:  "invalid integer",
+			param: ParameterDescriptor{Name: "count", Type: SchemaTypeInteger},
+			value: "1.5",
+			err:   "count must be an integer",
+		},
+		{
+			name:  "boolean",
+			param: ParameterDescriptor{Name: "includeDirection", Type: SchemaTypeBoolean},
+			value: "true",
+			want:  true,
+		},
+		{
+			name:  "invalid boolean",
+			param: ParameterDescriptor{Name: "includeDirection", Type: SchemaTypeBoolean},
+			value: "yes",
+			err:   "includeDirection must be a boolean",
+		},
+		{
+			name:  "float",
+			param: ParameterDescriptor{Name: "ratio", Type: SchemaTypeNumber},
+			value: "0.25",
+			want:  0.25,
+		},
+		{
+			name:  "integer as float",
+			param: ParameterDescriptor{Name: "ratio", Type: SchemaTypeNumber},
+			value: "3",
+			want:  float64(3),
+		},
+		{
+			name:  "invalid float",
+			param: ParameterDescriptor{Name: "ratio", Type: SchemaTypeNumber},
+			value: "half",
+			err:   "ratio must be a number",
+		},
+		{
+			name:  "comma separated list",
+			param: ParameterDescriptor{Name: "tickers", Type: SchemaTypeArray},
+			value: "AAPL,CFLT",
+			want:  []interface{}{"AAPL", "CFLT"},
+		},
+		{
+			name:  "empty list",
+			param: ParameterDescriptor{Name: "tickers", Type: SchemaTypeArray},
+			value: "",
+			want:  []interface{}{},
+		},
+		{
+			name:  "JSON list",
+			param: ParameterDescriptor{Name: "ports", Type: SchemaTypeArray},
+			value: "[80, 443]",
+			want:  []interface{}{float64(80), float64(443)},
+		},
+		{
+			name:  "invalid JSON list",
+			param: ParameterDescriptor{Name: "ports", Type: SchemaTypeArray},
+			value: "[80,",
+			err:   "ports must be a list",
+		},
+		{
+			name:  "enum",
+			param: ParameterDescriptor{Name: "unit", Type: SchemaTypeString, Enum: []interface{}{"c", "f"}},
+			value: "f",
+			want:  "f",
+		},
+		{
+			name:  "not in enum",
+			param: ParameterDescriptor{Name: "unit", Type: SchemaTypeString, Enum: []interface{}{"c", "f"}},
+			value: "k",
+			err:   "unit must be one of c, f",
+		},
+		{
+			name:  "integer enum",
+			param: ParameterDescriptor{Name: "precision", Type: SchemaTypeInteger, Enum: []interface{}{0, 2}},
+			value: "2",
+			want:  int64(2),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.param.Parse(test.value)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("expected %#v, got %#v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestArgumentsSchema(t *testing.T) {
+	fn := FunctionDescriptor{
+		Name: "ticker",
+		Parameters: []ParameterDescriptor{
+			{Name: "ticker", Type: SchemaTypeString, Required: true},
+			{Name: "includeDirection", Type: SchemaTypeBoolean},
+		},
+	}
+
+	tests := []struct {
+		name string
+		args string
+		err  string
+	}{
+		{name: "valid", args: `{"ticker": "AAPL", "includeDirection": true}`},
+		{name: "required parameter", args: `{"includeDirection": true}`, err: "args.ticker is required"},
+		{name: "type mismatch", args: `{"ticker": "AAPL", "includeDirection": "true"}`, err: "args.includeDirection must be a boolean"},
+		{name: "unknown parameter", args: `{"ticker": "AAPL", "other": 1}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fn.ArgumentsSchema().Validate("args", decode(t, test.args))
+			if test.err == "" && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// the schema set by the plugin wins over the parameters
+	fn.ArgsSchema = &Schema{Type: SchemaTypeObject, AdditionalProperties: SchemaFalse()}
+	if err := fn.ArgumentsSchema().Validate("args", decode(t, `{"ticker": "AAPL"}`)); err == nil {
+		t.Fatal("expected the arguments schema of the function to be used")
+	}
+}
+
+func TestFunctionDescriptorUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want []ParameterDescriptor
+	}{
+		{
+			name: "parameters",
+			raw:  `{"name": "ticker", "parameters": [{"name": "ticker", "type": "string", "required": true}]}`,
+			want: []ParameterDescriptor{{Name: "ticker", Type: SchemaTypeString, Required: true}},
+		},
+		{
+			name: "legacy parameters",
+			raw:  `{"name": "ticker", "parameters": {"ticker": "the ticker", "includeDirection": "show the trend"}}`,
+			want: []ParameterDescriptor{
+				{Name: "includeDirection", Description: "show the trend"},
+				{Name: "ticker", Description: "the ticker"},
+			},
+		},
+		{
+			name: "no parameters",
+			raw:  `{"name": "ticker"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var fn FunctionDescriptor
+			if err := json.Unmarshal([]byte(test.raw), &fn); err != nil {
+				t.Fatal(err)
+			}
+			if fn.Name != "ticker" {
+				t.Fatalf("unexpected name %q", fn.Name)
+			}
+			if !reflect.DeepEqual(fn.Parameters, test.want) {
+				t.Fatalf("expected %#v, got %#v", test.want, fn.Parameters)
+			}
+		})
+	}
+}
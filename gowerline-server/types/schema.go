@@ -0,0 +1,306 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// JSON Schema types understood by Schema.Validate
+const (
+	SchemaTypeString  = "string"
+	SchemaTypeInteger = "integer"
+	SchemaTypeNumber  = "number"
+	SchemaTypeBoolean = "boolean"
+	SchemaTypeObject  = "object"
+	SchemaTypeArray   = "array"
+)
+
+// Formats of strings understood by Schema.Validate
+const (
+	// SchemaFormatDuration is a duration parsed by time.ParseDuration
+	SchemaFormatDuration = "duration"
+	// SchemaFormatRegex is a regular expression compiled by regexp.Compile
+	SchemaFormatRegex = "regex"
+)
+
+// Schema is a JSON Schema describing the configuration of a plugin or the
+// arguments of a function. Only the subset of the specification below is
+// supported, which is enough to describe the settings of the plugins.
+type Schema struct {
+	Type        string             `json:"type,omitempty" yaml:"type,omitempty"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Format      string             `json:"format,omitempty" yaml:"format,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty" yaml:"required,omitempty"`
+	// AdditionalProperties describes the values of the keys of an object that
+	// are not listed in Properties, use SchemaFalse to forbid such keys
+	AdditionalProperties *Schema       `json:"additionalProperties,omitempty" yaml:"additionalProperties,omitempty"`
+	Items                *Schema       `json:"items,omitempty" yaml:"items,omitempty"`
+	Enum                 []interface{} `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Default              interface{}   `json:"default,omitempty" yaml:"default,omitempty"`
+	Minimum              *float64      `json:"minimum,omitempty" yaml:"minimum,omitempty"`
+	Maximum              *float64      `json:"maximum,omitempty" yaml:"maximum,omitempty"`
+	Pattern              string        `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+
+	// never is set for the `false` schema, which no value validates against
+	never bool
+	// pattern holds Pattern once compiled, Pattern must not change afterwards
+	pattern atomic.Value
+}
+
+// SchemaFalse returns the `false` schema, no value validates against it
+func SchemaFalse() *Schema {
+	return &Schema{never: true}
+}
+
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	if s.never {
+		return []byte("false"), nil
+	}
+	type schema Schema
+	return json.Marshal((*schema)(s))
+}
+
+func (s *Schema) MarshalYAML() (interface{}, error) {
+	if s.never {
+		return false, nil
+	}
+	type schema Schema
+	return (*schema)(s), nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	switch strings.TrimSpace(string(data)) {
+	case "false":
+		*s = Schema{never: true}
+		return nil
+	case "true":
+		*s = Schema{}
+		return nil
+	}
+	type schema Schema
+	return json.Unmarshal(data, (*schema)(s))
+}
+
+// Validate checks a value decoded from JSON or YAML against the schema, path is
+// the name of the value used in the errors, such as `finnhub.tickers must be a
+// list of strings`. Every problem found is reported in the returned error.
+func (s *Schema) Validate(path string, value interface{}) error {
+	if s == nil {
+		return nil
+	}
+	if s.never {
+		return fmt.Errorf("%s is not allowed", path)
+	}
+
+	if s.Type != "" && !s.hasType(value) {
+		return fmt.Errorf("%s must be %s", path, s.describe())
+	}
+
+	var errs error
+	if len(s.Enum) != 0 && !s.inEnum(value) {
+		choices := make([]string, 0, len(s.Enum))
+		for _, choice := range s.Enum {
+			choices = append(choices, fmt.Sprintf("%v", choice))
+		}
+		errs = multierr.Append(errs, fmt.Errorf("%s must be one of %s", path, strings.Join(choices, ", ")))
+	}
+
+	switch v := value.(type) {
+	case string:
+		errs = multierr.Append(errs, s.validateString(path, v))
+	case map[string]interface{}:
+		errs = multierr.Append(errs, s.validateObject(path, v))
+	case []interface{}:
+		for idx, item := range v {
+			errs = multierr.Append(errs, s.Items.Validate(fmt.Sprintf("%s[%d]", path, idx), item))
+		}
+	default:
+		if number, ok := toFloat(value); ok {
+			if s.Minimum != nil && number < *s.Minimum {
+				errs = multierr.Append(errs, fmt.Errorf("%s must be at least %v", path, *s.Minimum))
+			}
+			if s.Maximum != nil && number > *s.Maximum {
+				errs = multierr.Append(errs, fmt.Errorf("%s must be at most %v", path, *s.Maximum))
+			}
+		}
+	}
+
+	return errs
+}
+
+func (s *Schema) validateString(path string, value string) error {
+	switch s.Format {
+	case SchemaFormatDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("%s must be a duration such as 30s or 5m", path)
+		}
+	case SchemaFormatRegex:
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("%s must be a valid regular expression: %w", path, err)
+		}
+	}
+
+	if s.Pattern != "" {
+		re, err := s.compiledPattern()
+		if err != nil {
+			return fmt.Errorf("invalid pattern for %s: %w", path, err)
+		}
+		if !re.MatchString(value) {
+			return fmt.Errorf("%s must match %s", path, s.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// compiledPattern compiles Pattern the first time the schema validates a string
+func (s *Schema) compiledPattern() (*regexp.Regexp, error) {
+	if re, ok := s.pattern.Load().(*regexp.Regexp); ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(s.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	s.pattern.Store(re)
+	return re, nil
+}
+
+func (s *Schema) validateObject(path string, value map[string]interface{}) error {
+	var errs error
+	for _, name := range s.Required {
+		if _, ok := value[name]; !ok {
+			errs = multierr.Append(errs, fmt.Errorf("%s.%s is required", path, name))
+		}
+	}
+
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if property, ok := s.Properties[key]; ok {
+			errs = multierr.Append(errs, property.Validate(path+"."+key, value[key]))
+		} else if s.AdditionalProperties != nil {
+			errs = multierr.Append(errs, s.AdditionalProperties.Validate(path+"."+key, value[key]))
+		}
+	}
+
+	return errs
+}
+
+func (s *Schema) hasType(value interface{}) bool {
+	switch s.Type {
+	case SchemaTypeString:
+		_, ok := value.(string)
+		return ok
+	case SchemaTypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case SchemaTypeNumber:
+		_, ok := toFloat(value)
+		return ok
+	case SchemaTypeInteger:
+		number, ok := toFloat(value)
+		return ok && number == math.Trunc(number)
+	case SchemaTypeObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case SchemaTypeArray:
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return true
+}
+
+func (s *Schema) inEnum(value interface{}) bool {
+	for _, choice := range s.Enum {
+		// lists and maps cannot be compared with ==
+		if reflect.DeepEqual(choice, value) {
+			return true
+		}
+		// numbers may have been decoded to different types
+		a, aOk := toFloat(choice)
+		b, bOk := toFloat(value)
+		if aOk && bOk && a == b {
+			return true
+		}
+	}
+	return false
+}
+
+// describe returns what the values matching the schema are, in plain english
+func (s *Schema) describe() string {
+	switch s.Type {
+	case SchemaTypeString:
+		if s.Format == SchemaFormatDuration {
+			return "a duration"
+		}
+		return "a string"
+	case SchemaTypeInteger:
+		return "an integer"
+	case SchemaTypeNumber:
+		return "a number"
+	case SchemaTypeBoolean:
+		return "a boolean"
+	case SchemaTypeObject:
+		return "a map"
+	case SchemaTypeArray:
+		if s.Items != nil && s.Items.Type != "" {
+			return "a list of " + s.Items.describePlural()
+		}
+		return "a list"
+	}
+	return s.Type
+}
+
+func (s *Schema) describePlural() string {
+	switch s.Type {
+	case SchemaTypeString:
+		if s.Format == SchemaFormatDuration {
+			return "durations"
+		}
+		return "strings"
+	case SchemaTypeInteger:
+		return "integers"
+	case SchemaTypeNumber:
+		return "numbers"
+	case SchemaTypeBoolean:
+		return "booleans"
+	case SchemaTypeObject:
+		return "maps"
+	case SchemaTypeArray:
+		return "lists"
+	}
+	return s.Type
+}
+
+// toFloat converts the numbers yaml and json decode to
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,254 @@
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"go.uber.org/multierr"
+)
+
+func float(value float64) *float64 {
+	return &value
+}
+
+// decode returns a value the way the configuration or the arguments are decoded
+func decode(t *testing.T, raw string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		t.Fatalf("invalid test value %s: %s", raw, err)
+	}
+	return value
+}
+
+func TestSchemaValidate(t *testing.T) {
+	server := &Schema{
+		Type:     SchemaTypeObject,
+		Required: []string{"host"},
+		Properties: map[string]*Schema{
+			"host": {Type: SchemaTypeString},
+			"port": {Type: SchemaTypeInteger, Minimum: float(1), Maximum: float(65535)},
+		},
+		AdditionalProperties: SchemaFalse(),
+	}
+	config := &Schema{
+		Type:     SchemaTypeObject,
+		Required: []string{"token", "tickers"},
+		Properties: map[string]*Schema{
+			"token":   {Type: SchemaTypeString},
+			"tickers": {Type: SchemaTypeArray, Items: &Schema{Type: SchemaTypeString}},
+			"refresh": {Type: SchemaTypeString, Format: SchemaFormatDuration},
+			"ratio":   {Type: SchemaTypeNumber},
+			"enabled": {Type: SchemaTypeBoolean},
+			"level":   {Type: SchemaTypeString, Enum: []interface{}{"debug", "info"}},
+			"retries": {Type: SchemaTypeInteger, Enum: []interface{}{1, 3, 5}},
+			"regex":   {Type: SchemaTypeString, Format: SchemaFormatRegex},
+			"name":    {Type: SchemaTypeString, Pattern: "^[a-z]+$"},
+			"id":      {Type: SchemaTypeString, Pattern: "("},
+			"columns": {Type: SchemaTypeArray, Enum: []interface{}{[]interface{}{"symbol", "price"}, []interface{}{"symbol"}}},
+			"colours": {Type: SchemaTypeObject, Enum: []interface{}{map[string]interface{}{"fg": "white", "bg": "red"}}},
+			"server":  server,
+			"labels":  {Type: SchemaTypeObject, AdditionalProperties: &Schema{Type: SchemaTypeString}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		schema *Schema
+		value  string
+		// errs are the errors expected, in order, none when empty
+		errs []string
+	}{
+		{
+			name:   "valid",
+			schema: config,
+			value:  `{"token": "t", "tickers": ["AAPL"], "refresh": "5m", "ratio": 1.5, "enabled": true, "level": "info", "retries": 3}`,
+		},
+		{
+			name:   "nil schema",
+			schema: nil,
+			value:  `{"anything": 1}`,
+		},
+		{
+			name:   "required fields",
+			schema: config,
+			value:  `{}`,
+			errs:   []string{"cfg.token is required", "cfg.tickers is required"},
+		},
+		{
+			name:   "object type mismatch",
+			schema: config,
+			value:  `["token"]`,
+			errs:   []string{"cfg must be a map"},
+		},
+		{
+			name:   "string type mismatch",
+			schema: config,
+			value:  `{"token": 42, "tickers": []}`,
+			errs:   []string{"cfg.token must be a string"},
+		},
+		{
+			name:   "list type mismatch",
+			schema: config,
+			value:  `{"token": "t", "tickers": "AAPL"}`,
+			errs:   []string{"cfg.tickers must be a list of strings"},
+		},
+		{
+			name:   "list item type mismatch",
+			schema: config,
+			value:  `{"token": "t", "tickers": ["AAPL", 42]}`,
+			errs:   []string{"cfg.tickers[1] must be a string"},
+		},
+		{
+			name:   "integer type mismatch",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "server": {"host": "h", "port": 80.5}}`,
+			errs:   []string{"cfg.server.port must be an integer"},
+		},
+		{
+			name:   "number type mismatch",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "ratio": "half"}`,
+			errs:   []string{"cfg.ratio must be a number"},
+		},
+		{
+			name:   "boolean type mismatch",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "enabled": "yes"}`,
+			errs:   []string{"cfg.enabled must be a boolean"},
+		},
+		{
+			name:   "duration format",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "refresh": "often"}`,
+			errs:   []string{"cfg.refresh must be a duration such as 30s or 5m"},
+		},
+		{
+			name:   "regex format",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "regex": "("}`,
+			errs:   []string{"cfg.regex must be a valid regular expression"},
+		},
+		{
+			name:   "pattern",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "name": "Name"}`,
+			errs:   []string{"cfg.name must match ^[a-z]+$"},
+		},
+		{
+			name:   "enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "level": "trace"}`,
+			errs:   []string{"cfg.level must be one of debug, info"},
+		},
+		{
+			name:   "numeric enum decoded as float",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "retries": 5}`,
+		},
+		{
+			name:   "numeric enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "retries": 2}`,
+			errs:   []string{"cfg.retries must be one of 1, 3, 5"},
+		},
+		{
+			name:   "list enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "columns": ["symbol"]}`,
+		},
+		{
+			name:   "list not in enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "columns": ["price"]}`,
+			errs:   []string{"cfg.columns must be one of [symbol price], [symbol]"},
+		},
+		{
+			name:   "map enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "colours": {"bg": "red", "fg": "white"}}`,
+		},
+		{
+			name:   "map not in enum",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "colours": {"fg": "white"}}`,
+			errs:   []string{"cfg.colours must be one of map[bg:red fg:white]"},
+		},
+		{
+			name:   "invalid pattern",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "id": "abc"}`,
+			errs:   []string{"invalid pattern for cfg.id"},
+		},
+		{
+			name:   "nested object",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "server": {"host": "h", "port": 8080}}`,
+		},
+		{
+			name:   "nested required field",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "server": {"port": 8080}}`,
+			errs:   []string{"cfg.server.host is required"},
+		},
+		{
+			name:   "nested bounds",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "server": {"host": "h", "port": 0}}`,
+			errs:   []string{"cfg.server.port must be at least 1"},
+		},
+		{
+			name:   "nested additional properties",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "server": {"host": "h", "tls": true}}`,
+			errs:   []string{"cfg.server.tls is not allowed"},
+		},
+		{
+			name:   "additional properties schema",
+			schema: config,
+			value:  `{"token": "t", "tickers": [], "labels": {"env": "prod", "tier": 1}}`,
+			errs:   []string{"cfg.labels.tier must be a string"},
+		},
+		{
+			name:   "every error is reported",
+			schema: config,
+			value:  `{"tickers": [1], "enabled": 1}`,
+			errs:   []string{"cfg.token is required", "cfg.enabled must be a boolean", "cfg.tickers[0] must be a string"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.schema.Validate("cfg", decode(t, test.value))
+			errs := multierr.Errors(err)
+			if len(errs) != len(test.errs) {
+				t.Fatalf("expected %d errors %v, got %v", len(test.errs), test.errs, err)
+			}
+			for idx, expected := range test.errs {
+				if !strings.HasPrefix(errs[idx].Error(), expected) {
+					t.Errorf("expected error %q, got %q", expected, errs[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestSchemaFalseJSON(t *testing.T) {
+	schema := &Schema{Type: SchemaTypeObject, AdditionalProperties: SchemaFalse()}
+	b, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"type":"object","additionalProperties":false}` {
+		t.Fatalf("unexpected JSON %s", b)
+	}
+
+	var decoded Schema
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Validate("cfg", map[string]interface{}{"key": "value"}); err == nil {
+		t.Fatal("expected the additional property to be refused")
+	}
+}
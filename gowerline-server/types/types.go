@@ -1,6 +1,9 @@
 package types
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type VimInfo struct {
 	WindowNumber int64  `json:"winnr"`
@@ -18,6 +21,39 @@ type Payload struct {
 	Vim      *VimInfo          `json:"vim"`
 }
 
+// BatchRequest renders several segments at once, the payloads
+// inherit the env, cwd and vim info they do not set themselves
+type BatchRequest struct {
+	Env      map[string]string `json:"env"`
+	Cwd      string            `json:"cwd"`
+	Vim      *VimInfo          `json:"vim"`
+	Payloads []Payload         `json:"payloads"`
+}
+
+// Payload returns the idx-th payload of the batch, with the shared fields filled in
+func (r *BatchRequest) Payload(idx int) *Payload {
+	payload := r.Payloads[idx]
+	if payload.Env == nil {
+		payload.Env = r.Env
+	}
+	if payload.Cwd == "" {
+		payload.Cwd = r.Cwd
+	}
+	if payload.Vim == nil {
+		payload.Vim = r.Vim
+	}
+	return &payload
+}
+
+// BatchResult is the outcome of one of the payloads of a batch, Status
+// is the HTTP status the call would have had on its own
+type BatchResult struct {
+	Function string             `json:"function" yaml:"function"`
+	Status   int                `json:"status" yaml:"status"`
+	Error    string             `json:"error,omitempty" yaml:"error,omitempty"`
+	Segments []*PowerlineReturn `json:"segments" yaml:"segments"`
+}
+
 // This represents the object powerline will read as
 // the segment data (for one segment)
 // Taken from https://powerline.readthedocs.io/en/master/develop/segments.html
@@ -38,10 +74,26 @@ type PluginStartData struct {
 	Metadata PluginMetadata
 }
 
+// CacheDescriptor lets the server cache the result of a function. The cache key is
+// made of the function, its arguments, and the environment variables and working
+// directory the result depends on. Once the TTL expires, the stale result is still
+// returned while a fresh one is computed in the background.
+type CacheDescriptor struct {
+	TTL time.Duration `json:"ttl" yaml:"ttl"`
+	Env []string      `json:"env,omitempty" yaml:"env,omitempty"`
+	Cwd bool          `json:"cwd,omitempty" yaml:"cwd,omitempty"`
+}
+
 type FunctionDescriptor struct {
-	Name        string            `json:"name" yaml:"name"`
-	Description string            `json:"description" yaml:"description"`
-	Parameters  map[string]string `json:"parameters" yaml:"parameters"`
+	Name        string                `json:"name" yaml:"name"`
+	Description string                `json:"description" yaml:"description"`
+	Parameters  []ParameterDescriptor `json:"parameters" yaml:"parameters"`
+	// Cache is optional, results are not cached unless a TTL is set
+	Cache *CacheDescriptor `json:"cache,omitempty" yaml:"cache,omitempty"`
+	// ArgsSchema is optional, the arguments of the calls are validated against
+	// it before reaching the plugin. It is only needed for arguments that the
+	// Parameters cannot describe, the schema is built from them otherwise.
+	ArgsSchema *Schema `json:"args_schema,omitempty" yaml:"args_schema,omitempty"`
 }
 
 type PluginMetadata struct {
@@ -49,6 +101,66 @@ type PluginMetadata struct {
 	Functions   []FunctionDescriptor `json:"functions" yaml:"functions"`
 	Author      string               `json:"author" yaml:"author"`
 	Version     string               `json:"version" yaml:"version"`
+	// ConfigSchema is optional, when set the configuration of the plugin
+	// is validated against it before the plugin is started. It must be
+	// set on the Plugin returned by Init to be taken into account.
+	ConfigSchema *Schema `json:"config_schema,omitempty" yaml:"config_schema,omitempty"`
+}
+
+const (
+	BreakerStateClosed   = "closed"
+	BreakerStateOpen     = "open"
+	BreakerStateHalfOpen = "half-open"
+)
+
+// BreakerStatus is the state of the circuit breaker of a plugin
+type BreakerStatus struct {
+	State               string     `json:"state" yaml:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures" yaml:"consecutive_failures"`
+	OpenUntil           *time.Time `json:"open_until,omitempty" yaml:"open_until,omitempty"`
+}
+
+const (
+	// PluginStateIdle is the state of lazy plugins that were never called
+	PluginStateIdle     = "idle"
+	PluginStateStarting = "starting"
+	PluginStateRunning  = "running"
+	PluginStateDegraded = "degraded"
+	PluginStateStopped  = "stopped"
+	// PluginStateDisabled is the state of the plugins disabled at runtime
+	PluginStateDisabled = "disabled"
+)
+
+// PluginHealth is reported by the plugins implementing the optional Health hook
+type PluginHealth struct {
+	// Healthy is false when the plugin cannot do its job, for
+	// instance when it fails to reach the API it gets its data from
+	Healthy     bool       `json:"healthy" yaml:"healthy"`
+	LastError   string     `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty" yaml:"last_refresh,omitempty"`
+}
+
+// CallCounters counts the calls made to the functions of a plugin
+type CallCounters struct {
+	Total    uint64 `json:"total" yaml:"total"`
+	Errors   uint64 `json:"errors" yaml:"errors"`
+	Timeouts uint64 `json:"timeouts" yaml:"timeouts"`
+	// Rejected calls were short-circuited by the breaker
+	Rejected uint64 `json:"rejected" yaml:"rejected"`
+}
+
+// PluginStatus is returned by the server for every configured plugin
+type PluginStatus struct {
+	PluginMetadata `yaml:",inline"`
+	State          string        `json:"state" yaml:"state"`
+	Breaker        BreakerStatus `json:"breaker" yaml:"breaker"`
+	LastError      string        `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastErrorTime  *time.Time    `json:"last_error_time,omitempty" yaml:"last_error_time,omitempty"`
+	// LastSuccess is the last time a call succeeded or
+	// the plugin successfully refreshed its data
+	LastSuccess *time.Time    `json:"last_success,omitempty" yaml:"last_success,omitempty"`
+	Calls       CallCounters  `json:"calls" yaml:"calls"`
+	Health      *PluginHealth `json:"health,omitempty" yaml:"health,omitempty"`
 }
 
 // ServerVersioInfo contains various infos about the server
@@ -61,3 +173,18 @@ type ServerVersionInfo struct {
 	Architecture    string `json:"architecture" yaml:"architecture"`
 	OperatingSystem string `json:"operating_system" yaml:"operating_system"`
 }
+
+// LogLevels are the level of the logs of the server, and the
+// ones of the plugins that log at their own level
+type LogLevels struct {
+	Level   string            `json:"level" yaml:"level"`
+	Plugins map[string]string `json:"plugins,omitempty" yaml:"plugins,omitempty"`
+}
+
+// LogLevelRequest changes the level of the logs of the server, or the one of
+// a plugin when Plugin is set. The `default` level makes the plugin log at the
+// level of the server again.
+type LogLevelRequest struct {
+	Level  string `json:"level" yaml:"level"`
+	Plugin string `json:"plugin,omitempty" yaml:"plugin,omitempty"`
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// ActivationListeners returns the sockets systemd passed to the server when it
+// is socket activated, and none when it is not. The connections made before the
+// server was ready are waiting in their backlog.
+func ActivationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the plugins started by the server must not think they are activated too
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, fds)
+	for idx := 0; idx < fds; idx++ {
+		fd := listenFdsStart + idx
+		syscall.CloseOnExec(fd)
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if idx < len(names) && names[idx] != "" {
+			name = names[idx]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use the socket %s passed by systemd: %w", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connPollInterval is how often the connections are checked while waiting for them
+const connPollInterval = 10 * time.Millisecond
+
+// ConnTracker keeps track of the connections of a server that are being read or served.
+// Once it is shutting down, net/http drops the requests it reads afterwards without an
+// answer, so the connections accepted right before are waited for first.
+type ConnTracker struct {
+	mu   sync.Mutex
+	busy map[net.Conn]bool
+}
+
+// NewConnTracker returns a new connection tracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{busy: make(map[net.Conn]bool)}
+}
+
+// ConnState is the ConnState hook of the server
+func (t *ConnTracker) ConnState(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateNew, http.StateActive:
+		t.busy[conn] = true
+	default:
+		delete(t.busy, conn)
+	}
+}
+
+// WaitIdle waits until none of the connections is being read or served
+func (t *ConnTracker) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(connPollInterval)
+	defer ticker.Stop()
+
+	for {
+		t.mu.Lock()
+		busy := len(t.busy)
+		t.mu.Unlock()
+		if busy == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -3,40 +3,51 @@ package utils
 import (
 	"context"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
-	"os/user"
-	"path/filepath"
-	"strings"
 
 	"github.com/thomas-maurice/gowerline/gowerline-server/config"
-	"go.uber.org/zap"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
 )
 
-func NewHTTPClientFromConfig(cfg *config.Config) *http.Client {
-	currentUser, err := user.Current()
-	if err != nil {
-		log.Panic("could not get current user", zap.Error(err))
-	}
-	homeDir := currentUser.HomeDir
-	listenPath := cfg.Listen.Unix
-
-	if strings.HasPrefix(cfg.Listen.Unix, "~/") {
-		listenPath = filepath.Join(homeDir, cfg.Listen.Unix[2:])
-	}
+// NewHTTPClientFromConfig returns a client talking to the server, it fails
+// when the server listens with a token that cannot be read
+func NewHTTPClientFromConfig(cfg *config.Config) (*http.Client, error) {
+	listenPath := paths.Expand(cfg.Listen.Unix)
 
-	if cfg.Listen.Unix != "" {
+	if listenPath != "" {
 		return &http.Client{
 			Transport: &http.Transport{
 				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
 					return net.Dial("unix", listenPath)
 				},
 			},
+		}, nil
+	}
+
+	if cfg.Listen.Token {
+		token, err := ReadToken(cfg.Listen.TokenPath())
+		if err != nil {
+			return nil, fmt.Errorf("could not read the token: %w", err)
 		}
+		return &http.Client{
+			Transport: &bearerTransport{token: token, next: http.DefaultTransport},
+		}, nil
 	}
 
-	return &http.Client{}
+	return &http.Client{}, nil
+}
+
+// bearerTransport authenticates the requests made to the TCP listener
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
 }
 
 func BaseURLFromConfig(cfg *config.Config) string {
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+)
+
+// ErrLocked is returned when another process holds the lock
+var ErrLocked = errors.New("locked by another process")
+
+// LockFile takes an exclusive lock on the file, it is held until the returned
+// file is closed or the process exits, whichever happens first
+func LockFile(file string) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Locked tells whether another process holds the lock on the file. It is only
+// taken for as long as it takes to check it, the file is not created.
+func Locked(file string) (bool, error) {
+	f, err := os.OpenFile(file, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return false, syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
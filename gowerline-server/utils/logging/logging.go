@@ -0,0 +1,261 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logging builds the loggers of the server and of the plugins. Their levels can be
+// changed at runtime, and each plugin can log at another level than the server.
+type Logging struct {
+	// core writes the entries of every level, the
+	// loggers decide which ones get to it
+	core   zapcore.Core
+	output *sink
+	level  zap.AtomicLevel
+
+	// mutex guards plugins, the levels of the plugins overriding the one of the server
+	mutex   *sync.RWMutex
+	plugins map[string]zapcore.Level
+}
+
+// New sets the logs up as configured, they go to stderr unless a log file is set
+func New(cfg config.ConfigLog) (*Logging, error) {
+	l := &Logging{
+		output: &sink{
+			mutex:  &sync.RWMutex{},
+			output: zapcore.Lock(os.Stderr),
+		},
+		level:   zap.NewAtomicLevel(),
+		mutex:   &sync.RWMutex{},
+		plugins: make(map[string]zapcore.Level),
+	}
+	if err := l.Configure(cfg); err != nil {
+		return nil, err
+	}
+
+	// sampled the same way as zap's production logger
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), l.output, zapcore.DebugLevel)
+	l.core = zapcore.NewSamplerWithOptions(core, time.Second, 100, 100)
+
+	return l, nil
+}
+
+// Configure sets the levels of the server and of the plugins back to the configured
+// ones, and switches the logs over to the configured file when its settings changed.
+// Nothing is changed when one of the levels is invalid or the file cannot be opened.
+func (l *Logging) Configure(cfg config.ConfigLog) error {
+	level, err := zapcore.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level: %w", err)
+	}
+
+	plugins := make(map[string]zapcore.Level, len(cfg.Plugins))
+	for name, value := range cfg.Plugins {
+		plugins[name], err = zapcore.ParseLevel(value)
+		if err != nil {
+			return fmt.Errorf("invalid log level for plugin %s: %w", name, err)
+		}
+	}
+
+	if err := l.output.configure(cfg.File); err != nil {
+		return fmt.Errorf("could not open the log file: %w", err)
+	}
+
+	l.level.SetLevel(level)
+	l.mutex.Lock()
+	l.plugins = plugins
+	l.mutex.Unlock()
+
+	return nil
+}
+
+// Logger returns the logger of the server
+func (l *Logging) Logger() *zap.Logger {
+	return l.LoggerAt(l.level)
+}
+
+// PluginLogger returns the logger of a plugin, it logs at the level of
+// the server unless the plugin has its own
+func (l *Logging) PluginLogger(name string) *zap.Logger {
+	return l.LoggerAt(&pluginLevel{logging: l, name: name})
+}
+
+// LoggerAt returns a logger writing along with the other ones, at the given level
+func (l *Logging) LoggerAt(level zapcore.LevelEnabler) *zap.Logger {
+	return zap.New(&levelCore{Core: l.core, level: level}, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+}
+
+// SetLevel changes the level of the server, and of the plugins that do not have their own
+func (l *Logging) SetLevel(level zapcore.Level) {
+	l.level.SetLevel(level)
+}
+
+// SetPluginLevel changes the level of a plugin
+func (l *Logging) SetPluginLevel(name string, level zapcore.Level) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.plugins[name] = level
+}
+
+// ResetPluginLevel makes a plugin log at the level of the server again
+func (l *Logging) ResetPluginLevel(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.plugins, name)
+}
+
+// PluginLevel returns the level a plugin logs at
+func (l *Logging) PluginLevel(name string) zapcore.Level {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if level, ok := l.plugins[name]; ok {
+		return level
+	}
+	return l.level.Level()
+}
+
+// Levels returns the level of the server and the ones of the plugins that have their own
+func (l *Logging) Levels() types.LogLevels {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	levels := types.LogLevels{
+		Level:   l.level.String(),
+		Plugins: make(map[string]string, len(l.plugins)),
+	}
+	for name, level := range l.plugins {
+		levels.Plugins[name] = level.String()
+	}
+	return levels
+}
+
+// Output is where the logs are written, for the processes
+// whose output should go along with the logs
+func (l *Logging) Output() io.Writer {
+	return l.output
+}
+
+// Close closes the log file, if any
+func (l *Logging) Close() error {
+	return l.output.Close()
+}
+
+// sink is where the logs are written: stderr, or the log file when one is set. The
+// loggers keep writing to it when it is switched over to another file.
+type sink struct {
+	// mutex guards the fields, it is held for writing while switching files
+	mutex  *sync.RWMutex
+	output zapcore.WriteSyncer
+	// file is the log file, if any, opened with settings
+	file     *RotatingFile
+	settings config.ConfigLogFile
+}
+
+// configure switches over to the log file of the settings, and back to stderr
+// when there is none. The previous file is only closed once it is no longer used.
+func (s *sink) configure(settings config.ConfigLogFile) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if settings == s.settings {
+		return nil
+	}
+
+	var output zapcore.WriteSyncer = zapcore.Lock(os.Stderr)
+	var file *RotatingFile
+	if settings.Path != "" {
+		var err error
+		file, err = OpenRotatingFile(settings.Path, int64(settings.MaxSize)*1024*1024, settings.MaxBackups)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.output = output
+	s.file = file
+	s.settings = settings
+
+	return nil
+}
+
+func (s *sink) Write(b []byte) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.output.Write(b)
+}
+
+func (s *sink) Sync() error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.output.Sync()
+}
+
+// Close closes the log file, if any, the logs go to stderr afterwards
+func (s *sink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.output = zapcore.Lock(os.Stderr)
+	s.file = nil
+	s.settings = config.ConfigLogFile{}
+	return err
+}
+
+// pluginLevel is the level of a plugin, which follows the
+// one of the server unless the plugin has its own
+type pluginLevel struct {
+	logging *Logging
+	name    string
+}
+
+func (p *pluginLevel) Enabled(level zapcore.Level) bool {
+	return p.Level().Enabled(level)
+}
+
+func (p *pluginLevel) Level() zapcore.Level {
+	return p.logging.PluginLevel(p.name)
+}
+
+// levelCore only lets the entries of its level through to the core, it may be
+// lower than the level of the core it wraps unlike zapcore.NewIncreaseLevelCore
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.level.Enabled(level)
+}
+
+// Level lets zapcore.LevelOf find out about the current level
+func (c *levelCore) Level() zapcore.Level {
+	return zapcore.LevelOf(c.level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(entry.Level) {
+		return checked
+	}
+	return c.Core.Check(entry, checked)
+}
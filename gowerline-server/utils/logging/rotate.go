@@ -0,0 +1,105 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// RotatingFile is a file that is rotated once it grows past its maximum size, the
+// rotated files are suffixed with .1 for the most recent one up to .N for the oldest
+type RotatingFile struct {
+	mutex      *sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens the file for appending, maxSize is in bytes
+func OpenRotatingFile(filePath string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		mutex:      &sync.Mutex{},
+		path:       filePath,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := os.MkdirAll(path.Dir(filePath), 0700); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("could not rotate the log file: %w", rotateErr)
+	}
+	return n, err
+}
+
+func (f *RotatingFile) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Sync()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, dropping the oldest one, and starts a new
+// file. The current file is reopened when it cannot be rotated, so that the logs
+// keep being written. It must be called with the mutex held
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+
+	var err error
+	for idx := f.maxBackups - 1; idx > 0 && err == nil; idx-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", f.path, idx), fmt.Sprintf("%s.%d", f.path, idx+1))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(f.path, f.path+".1")
+	}
+
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+// Package paths locates the directories of gowerline and expands the paths
+// found in the configuration and on the command line.
+//
+// The directories follow the XDG base directory specification: the configuration
+// lives in $XDG_CONFIG_HOME/gowerline, the plugins in $XDG_DATA_HOME/gowerline,
+// the storage of the plugins in $XDG_STATE_HOME/gowerline and the files that only
+// matter while the server runs in $XDG_RUNTIME_DIR/gowerline. When the configuration
+// directory does not exist but ~/.gowerline does, ~/.gowerline is used for all of
+// them instead, so that existing installations keep working.
+package paths
+
+import (
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	appName = "gowerline"
+	// legacyDir is the directory that held everything before the XDG directories
+	legacyDir = ".gowerline"
+)
+
+// xdgDefaults are the values of the XDG variables when they are not
+// set, relative to the home directory, as per the specification
+var xdgDefaults = map[string]string{
+	"XDG_CONFIG_HOME": ".config",
+	"XDG_DATA_HOME":   path.Join(".local", "share"),
+	"XDG_STATE_HOME":  path.Join(".local", "state"),
+}
+
+// Home returns the home directory of the user, the
+// current directory when it cannot be determined
+func Home() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "."
+	}
+	return home
+}
+
+// LegacyDir returns ~/.gowerline
+func LegacyDir() string {
+	return path.Join(Home(), legacyDir)
+}
+
+// ConfigDir holds the configuration file, its conf.d directory and the per plugin configuration files
+func ConfigDir() string {
+	return dir("XDG_CONFIG_HOME")
+}
+
+// DataDir holds the plugins directory
+func DataDir() string {
+	return dir("XDG_DATA_HOME")
+}
+
+// StateDir holds the storage of the plugins and the files the server generates
+func StateDir() string {
+	return dir("XDG_STATE_HOME")
+}
+
+// RuntimeDir holds the files that only matter while the server runs
+func RuntimeDir() string {
+	return dir("XDG_RUNTIME_DIR")
+}
+
+// legacy tells whether the installation uses ~/.gowerline for everything, which
+// is the case when it exists and the XDG configuration directory does not. It is
+// decided once for all the directories, so that the configuration and the state
+// of an installation are never looked for in different places.
+func legacy() bool {
+	return !isDir(path.Join(xdgDir("XDG_CONFIG_HOME"), appName)) && isDir(LegacyDir())
+}
+
+// dir returns the gowerline directory under the given XDG directory, and
+// ~/.gowerline for the legacy installations or when there is no such directory
+func dir(variable string) string {
+	base := xdgDir(variable)
+	if base == "" || legacy() {
+		return LegacyDir()
+	}
+	return path.Join(base, appName)
+}
+
+// xdgDir returns the value of an XDG variable or its default, which is
+// empty for XDG_RUNTIME_DIR as the specification does not define one
+func xdgDir(variable string) string {
+	if value := os.Getenv(variable); path.IsAbs(value) {
+		return value
+	}
+	if def, ok := xdgDefaults[variable]; ok {
+		return path.Join(Home(), def)
+	}
+	return ""
+}
+
+// Expand expands a leading `~` to the home directory and the `$VAR` and `${VAR}`
+// environment variables of a path. The XDG variables that are not set expand to
+// their default, and to ~/.gowerline for XDG_RUNTIME_DIR. Absolute and relative
+// paths are otherwise returned untouched.
+func Expand(p string) string {
+	if p == "" {
+		return p
+	}
+
+	p = os.Expand(p, func(variable string) string {
+		if value := os.Getenv(variable); value != "" {
+			return value
+		}
+		if variable == "XDG_RUNTIME_DIR" {
+			return LegacyDir()
+		}
+		return xdgDir(variable)
+	})
+
+	if p == "~" {
+		return Home()
+	}
+	if strings.HasPrefix(p, "~/") {
+		return path.Join(Home(), p[2:])
+	}
+	return p
+}
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
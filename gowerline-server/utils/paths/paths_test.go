@@ -0,0 +1,152 @@
+package paths
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// setHome points the home directory to a temporary one
+// with none of the XDG variables set
+func setHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, variable := range []string{"XDG_CONFIG_HOME", "XDG_DATA_HOME", "XDG_STATE_HOME", "XDG_RUNTIME_DIR"} {
+		t.Setenv(variable, "")
+	}
+	return home
+}
+
+func mkdir(t *testing.T, dir string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	home := setHome(t)
+	t.Setenv("XDG_STATE_HOME", "/var/lib/alice")
+	t.Setenv("GWL_TEST_DIR", "/opt/gowerline")
+
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "empty", path: "", want: ""},
+		{name: "home", path: "~", want: home},
+		{name: "under the home", path: "~/.gowerline/server.sock", want: path.Join(home, ".gowerline/server.sock")},
+		{name: "other user", path: "~alice/server.sock", want: "~alice/server.sock"},
+		{name: "absolute", path: "/run/gowerline.sock", want: "/run/gowerline.sock"},
+		{name: "relative", path: "gowerline.sock", want: "gowerline.sock"},
+		{name: "variable", path: "$GWL_TEST_DIR/plugins", want: "/opt/gowerline/plugins"},
+		{name: "braced variable", path: "${GWL_TEST_DIR}/plugins", want: "/opt/gowerline/plugins"},
+		{name: "set XDG variable", path: "$XDG_STATE_HOME/gowerline/token", want: "/var/lib/alice/gowerline/token"},
+		{name: "unset XDG variable", path: "$XDG_CONFIG_HOME/gowerline", want: path.Join(home, ".config/gowerline")},
+		{name: "unset XDG data variable", path: "${XDG_DATA_HOME}/gowerline", want: path.Join(home, ".local/share/gowerline")},
+		{name: "unset runtime directory", path: "$XDG_RUNTIME_DIR/gowerline.sock", want: path.Join(home, ".gowerline/gowerline.sock")},
+		{name: "unset variable", path: "$GWL_TEST_UNSET/gowerline.sock", want: "/gowerline.sock"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Expand(test.path); got != test.want {
+				t.Fatalf("expected %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func TestDirs(t *testing.T) {
+	tests := []struct {
+		name string
+		// legacy creates ~/.gowerline
+		legacy bool
+		// config creates the XDG configuration directory
+		config  bool
+		runtime bool
+		want    func(home string) map[string]string
+	}{
+		{
+			name: "new installation",
+			want: func(home string) map[string]string {
+				return map[string]string{
+					"config":  path.Join(home, ".config/gowerline"),
+					"data":    path.Join(home, ".local/share/gowerline"),
+					"state":   path.Join(home, ".local/state/gowerline"),
+					"runtime": path.Join(home, ".gowerline"),
+				}
+			},
+		},
+		{
+			name:    "new installation with a runtime directory",
+			runtime: true,
+			want: func(home string) map[string]string {
+				return map[string]string{
+					"config":  path.Join(home, ".config/gowerline"),
+					"data":    path.Join(home, ".local/share/gowerline"),
+					"state":   path.Join(home, ".local/state/gowerline"),
+					"runtime": path.Join(home, "run/gowerline"),
+				}
+			},
+		},
+		{
+			name:    "legacy installation",
+			legacy:  true,
+			runtime: true,
+			want: func(home string) map[string]string {
+				return map[string]string{
+					"config":  path.Join(home, ".gowerline"),
+					"data":    path.Join(home, ".gowerline"),
+					"state":   path.Join(home, ".gowerline"),
+					"runtime": path.Join(home, ".gowerline"),
+				}
+			},
+		},
+		{
+			name:    "legacy installation moved to the XDG configuration directory",
+			legacy:  true,
+			config:  true,
+			runtime: true,
+			want: func(home string) map[string]string {
+				return map[string]string{
+					"config":  path.Join(home, ".config/gowerline"),
+					"data":    path.Join(home, ".local/share/gowerline"),
+					"state":   path.Join(home, ".local/state/gowerline"),
+					"runtime": path.Join(home, "run/gowerline"),
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			home := setHome(t)
+			if test.legacy {
+				mkdir(t, path.Join(home, ".gowerline"))
+				// the state of the legacy installation does not decide on the layout
+				mkdir(t, path.Join(home, ".local/state/gowerline"))
+			}
+			if test.config {
+				mkdir(t, path.Join(home, ".config/gowerline"))
+			}
+			if test.runtime {
+				t.Setenv("XDG_RUNTIME_DIR", path.Join(home, "run"))
+			}
+
+			got := map[string]string{
+				"config":  ConfigDir(),
+				"data":    DataDir(),
+				"state":   StateDir(),
+				"runtime": RuntimeDir(),
+			}
+			for dir, want := range test.want(home) {
+				if got[dir] != want {
+					t.Errorf("expected the %s directory to be %q, got %q", dir, want, got[dir])
+				}
+			}
+		})
+	}
+}
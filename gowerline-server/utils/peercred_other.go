@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+const peerCredSupported = false
+
+func peerUID(conn net.Conn) (uint32, error) {
+	return 0, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WritePidFile writes the pid of the current process to the file
+func WritePidFile(file string) error {
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+}
+
+// RemovePidFile removes the pid file if it still holds the pid of the current
+// process, a server started in the meantime might have written its own
+func RemovePidFile(file string) error {
+	pid, err := ReadPidFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if pid != os.Getpid() {
+		return nil
+	}
+	return os.Remove(file)
+}
+
+// ReadPidFile returns the pid written in the file
+func ReadPidFile(file string) (int, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%s does not hold a valid pid", file)
+	}
+	return pid, nil
+}
+
+// ProcessAlive tells whether a process with the given pid is running as the
+// current user. A process of another user cannot be the server, its pid is
+// one that was reused since the pid file was written.
+func ProcessAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
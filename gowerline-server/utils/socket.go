@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/thomas-maurice/gowerline/gowerline-server/config"
+	"go.uber.org/zap"
+)
+
+// socketProbeTimeout bounds the check of an existing socket
+const socketProbeTimeout = time.Second
+
+// ErrSocketInUse is returned when another process listens on the socket
+var ErrSocketInUse = errors.New("another process listens on the socket")
+
+// ListenUnix listens on the unix socket with the mode and group of the configuration,
+// the connections of other users than the one running the server and the allowed
+// ones are closed right away
+func ListenUnix(log *zap.Logger, listenPath string, cfg *config.ConfigListen) (net.Listener, error) {
+	mode, err := cfg.SocketMode()
+	if err != nil {
+		return nil, err
+	}
+
+	gid := -1
+	if cfg.Group != "" {
+		gid, err = lookupGID(cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a socket nobody answers on is a leftover of a server that did not exit
+	// cleanly, but a live one belongs to a server that is still running
+	conn, err := net.DialTimeout("unix", listenPath, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return nil, ErrSocketInUse
+	}
+	os.Remove(listenPath)
+
+	// the socket is created with the mode the umask gives it, only we may connect
+	// to it until it gets its own. The umask is shared by the whole process, the
+	// socket is created before the server runs anything else.
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", listenPath)
+	syscall.Umask(umask)
+	if err != nil {
+		return nil, err
+	}
+	if gid != -1 {
+		if err := os.Chown(listenPath, -1, gid); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("could not set the group of the socket: %w", err)
+		}
+	}
+	if err := os.Chmod(listenPath, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not set the mode of the socket: %w", err)
+	}
+
+	checked, err := CheckPeerCredentials(log, listener, cfg)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return checked, nil
+}
+
+// CheckPeerCredentials wraps an unix socket listener so that it closes the connections
+// of other users than the one running the server and the allowed ones right away
+func CheckPeerCredentials(log *zap.Logger, listener net.Listener, cfg *config.ConfigListen) (net.Listener, error) {
+	allowed := map[uint32]bool{uint32(os.Getuid()): true}
+	for _, name := range cfg.AllowedUsers {
+		uid, err := lookupUID(name)
+		if err != nil {
+			return nil, err
+		}
+		allowed[uid] = true
+	}
+
+	if !peerCredSupported {
+		log.Warn("the users connecting to the socket cannot be checked on this platform, only its mode protects it")
+		return listener, nil
+	}
+
+	return &peerCredListener{Listener: listener, log: log, allowed: allowed}, nil
+}
+
+// peerCredListener only accepts the connections of the allowed users
+type peerCredListener struct {
+	net.Listener
+	log     *zap.Logger
+	allowed map[uint32]bool
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUID(conn)
+		if err != nil {
+			l.log.Error("could not get the credentials of the peer", zap.Error(err))
+			conn.Close()
+			continue
+		}
+		if !l.allowed[uid] {
+			l.log.Warn("refused connection from a user that is not allowed", zap.Uint32("uid", uid))
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+func lookupUID(name string) (uint32, error) {
+	if uid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(uid), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(uid), err
+}
+
+func lookupGID(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// tokenBytes is the number of random bytes of a generated token
+const tokenBytes = 32
+
+// LoadOrCreateToken reads the token of the TCP listener, it is generated
+// into a file only readable by the current user when it does not exist yet
+func LoadOrCreateToken(file string) (string, error) {
+	token, err := ReadToken(file)
+	if err == nil || !os.IsNotExist(err) {
+		return token, err
+	}
+
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate a token: %w", err)
+	}
+	token = hex.EncodeToString(b)
+
+	if err := os.MkdirAll(path.Dir(file), 0700); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		return "", err
+	}
+
+	return token, f.Close()
+}
+
+// ReadToken reads the token of the TCP listener, the file must not
+// be readable by anyone else than the current user
+func ReadToken(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s must only be accessible by its owner, its mode is %04o", file, info.Mode().Perm())
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The environment variables telling a server that it was started by the
+// upgrade of another one, and where the files it hands over are
+const (
+	handoverListenersEnv = "GOWERLINE_HANDOVER_LISTENERS"
+	handoverLockEnv      = "GOWERLINE_HANDOVER_LOCK_FD"
+	handoverReadyEnv     = "GOWERLINE_HANDOVER_READY_FD"
+	handoverReleasedEnv  = "GOWERLINE_HANDOVER_RELEASED_FD"
+
+	// handoverStartMargin is how long the new server has to serve once
+	// its plugins are started, on top of the startup timeout
+	handoverStartMargin = 5 * time.Second
+)
+
+// Handover is what a server being upgraded hands over to the new one
+type Handover struct {
+	// Listeners are the listeners of the previous server, they
+	// are shared by both servers until the previous one exits
+	Listeners []net.Listener
+	// Lock is the lock file of the previous server, the
+	// lock is held as long as one of them keeps it open
+	Lock *os.File
+	// ready tells the previous server to release the storage of the
+	// plugins first, and that the current one serves then
+	ready *os.File
+	// released is written to by the previous server once it released the storage
+	released *os.File
+}
+
+// InheritedHandover returns what the server being upgraded handed over, nil
+// when the current server was not started by an upgrade
+func InheritedHandover() (*Handover, error) {
+	count, err := strconv.Atoi(os.Getenv(handoverListenersEnv))
+	if err != nil {
+		return nil, nil
+	}
+	lockFd, err := strconv.Atoi(os.Getenv(handoverLockEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", handoverLockEnv, err)
+	}
+	readyFd, err := strconv.Atoi(os.Getenv(handoverReadyEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", handoverReadyEnv, err)
+	}
+
+	releasedFd, err := strconv.Atoi(os.Getenv(handoverReleasedEnv))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", handoverReleasedEnv, err)
+	}
+
+	// the plugins started by the server must not see them
+	os.Unsetenv(handoverListenersEnv)
+	os.Unsetenv(handoverLockEnv)
+	os.Unsetenv(handoverReadyEnv)
+	os.Unsetenv(handoverReleasedEnv)
+
+	handover := &Handover{}
+	for idx := 0; idx < count; idx++ {
+		fd := listenFdsStart + idx
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("listener-%d", idx))
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use the listener handed over: %w", err)
+		}
+		handover.Listeners = append(handover.Listeners, listener)
+	}
+
+	syscall.CloseOnExec(lockFd)
+	handover.Lock = os.NewFile(uintptr(lockFd), "lock")
+	syscall.CloseOnExec(readyFd)
+	handover.ready = os.NewFile(uintptr(readyFd), "ready")
+	syscall.CloseOnExec(releasedFd)
+	handover.released = os.NewFile(uintptr(releasedFd), "released")
+
+	return handover, nil
+}
+
+// Release asks the previous server to stop its plugins, which releases their storage
+// for the current one to start them, and waits for it. The previous server keeps
+// serving meanwhile.
+func (h *Handover) Release() error {
+	if _, err := h.ready.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	defer h.released.Close()
+	b := make([]byte, 1)
+	if _, err := h.released.Read(b); err != nil {
+		return fmt.Errorf("the previous server did not release the plugins: %w", err)
+	}
+	return nil
+}
+
+// Ready tells the previous server that the current one is about to serve
+// the requests, the previous one then drains its requests and exits
+func (h *Handover) Ready() error {
+	defer h.ready.Close()
+	_, err := h.ready.Write([]byte{1})
+	return err
+}
+
+// Upgrade runs the gowerline binary again with the same arguments, hands it the listeners
+// and the lock file, and waits for it to be ready to serve. Once the new server is up, it
+// asks for the plugins to be released, which calls release, and starts them again before
+// getting ready. The new server is killed if it does not get through either step in time,
+// and the current one can keep serving when an error is returned, having to start the
+// plugins again if they were released.
+func Upgrade(listeners []net.Listener, lock *os.File, timeout time.Duration, release func()) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		f, err := listenerFile(listener)
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, f)
+	}
+
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer readyRead.Close()
+	releasedRead, releasedWrite, err := os.Pipe()
+	if err != nil {
+		readyWrite.Close()
+		return 0, err
+	}
+	defer releasedWrite.Close()
+
+	server := exec.Command(executable, os.Args[1:]...)
+	server.Stdin = os.Stdin
+	server.Stdout = os.Stdout
+	server.Stderr = os.Stderr
+	server.ExtraFiles = append(append([]*os.File{}, files...), lock, readyWrite, releasedRead)
+	server.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%d", handoverListenersEnv, len(files)),
+		fmt.Sprintf("%s=%d", handoverLockEnv, listenFdsStart+len(files)),
+		fmt.Sprintf("%s=%d", handoverReadyEnv, listenFdsStart+len(files)+1),
+		fmt.Sprintf("%s=%d", handoverReleasedEnv, listenFdsStart+len(files)+2),
+	)
+	err = server.Start()
+	// only the new server may write to it from now on, so that its exit is noticed
+	readyWrite.Close()
+	releasedRead.Close()
+	// starting it put the listeners in blocking mode, which they share with the ones
+	// of the current server, whose Accept would then no longer be interrupted by Close
+	for _, f := range files {
+		syscall.SetNonblock(int(f.Fd()), true) //nolint:errcheck
+	}
+	if err != nil {
+		return 0, err
+	}
+	go server.Wait() //nolint:errcheck
+
+	if err := waitHandover(readyRead, timeout); err != nil {
+		server.Process.Kill()
+		return 0, fmt.Errorf("the new server did not ask for the plugins: %w", err)
+	}
+	release()
+	if _, err := releasedWrite.Write([]byte{1}); err != nil {
+		server.Process.Kill()
+		return 0, err
+	}
+
+	if err := waitHandover(readyRead, timeout+handoverStartMargin); err != nil {
+		server.Process.Kill()
+		return 0, fmt.Errorf("the new server did not get ready: %w", err)
+	}
+
+	return server.Process.Pid, nil
+}
+
+// waitHandover waits for the new server to write to the pipe
+func waitHandover(pipe *os.File, timeout time.Duration) error {
+	if err := pipe.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	if _, err := pipe.Read(b); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		return fmt.Errorf("it exited")
+	}
+	return nil
+}
+
+// listenerFile returns a copy of the file descriptor of the listener
+func listenerFile(listener net.Listener) (*os.File, error) {
+	if checked, ok := listener.(*peerCredListener); ok {
+		listener = checked.Listener
+	}
+
+	switch l := listener.(type) {
+	case *net.UnixListener:
+		// the socket is shared with the new server from now on
+		l.SetUnlinkOnClose(false)
+		return l.File()
+	case *net.TCPListener:
+		return l.File()
+	}
+
+	return nil, fmt.Errorf("cannot hand over a %T listener", listener)
+}
@@ -14,6 +14,7 @@ import traceback
 import yaml
 import os
 import os.path
+import re
 
 defaultConf = {
     "listen": {
@@ -21,24 +22,96 @@ defaultConf = {
     }
 }
 
-logPath = os.path.join(str(Path.home()), ".gowerline")
-cfgPath = os.path.join(str(Path.home()), ".gowerline", "gowerline.yaml")
+legacyDir = os.path.join(str(Path.home()), ".gowerline")
+
+# the values of the XDG variables when they are not set, as per the specification
+xdgDefaults = {
+    "XDG_CONFIG_HOME": ".config",
+    "XDG_DATA_HOME": os.path.join(".local", "share"),
+    "XDG_STATE_HOME": os.path.join(".local", "state"),
+}
+
+
+def xdgDir(variable):
+    """
+    Returns the value of an XDG variable or its default, which is
+    empty for XDG_RUNTIME_DIR as the specification does not define one
+    """
+    base = os.environ.get(variable, "")
+    if os.path.isabs(base):
+        return base
+    if variable in xdgDefaults:
+        return os.path.join(str(Path.home()), xdgDefaults[variable])
+    return ""
+
+
+def isLegacy():
+    """
+    Tells whether ~/.gowerline holds everything, the same way the server does:
+    it is the case when it exists and the XDG configuration directory does not
+    """
+    return (not os.path.isdir(os.path.join(xdgDir("XDG_CONFIG_HOME"), "gowerline"))
+            and os.path.isdir(legacyDir))
+
+
+def gowerlineDir(variable):
+    """
+    Returns the gowerline directory under an XDG base directory, the same way
+    the server does
+    """
+    base = xdgDir(variable)
+    if not base or isLegacy():
+        return legacyDir
+    return os.path.join(base, "gowerline")
+
+
+def expandPath(path):
+    """
+    Expands a path of the configuration the same way the server does: the XDG
+    variables that are not set expand to their default, and to ~/.gowerline
+    for XDG_RUNTIME_DIR
+    """
+    def expandVariable(match):
+        variable = match.group(1) or match.group(2)
+        value = os.environ.get(variable, "")
+        if value:
+            return value
+        if variable == "XDG_RUNTIME_DIR":
+            return legacyDir
+        return xdgDir(variable)
+
+    path = re.sub(r"\$(?:\{([^}]*)\}|([A-Za-z0-9_]+))", expandVariable, path)
+    return os.path.expanduser(path)
+
+
+logPath = gowerlineDir("XDG_STATE_HOME")
+cfgPath = os.path.join(gowerlineDir("XDG_CONFIG_HOME"), "gowerline.yaml")
 cfg = {}
 
 if not os.path.isdir(logPath):
-    os.mkdir(logPath)
+    os.makedirs(logPath)
 
 serverURL = ""
+headers = {}
 
 if os.path.isfile(cfgPath):
     with open(cfgPath, "r") as dat:
         cfg = yaml.load(dat, Loader=yaml.FullLoader)
-        if "listen" in cfg and "unix" in cfg["listen"]:
+        listen = cfg.get("listen") or {}
+        if listen.get("unix"):
             requests_unixsocket.monkeypatch()
             serverURL = "http+unix://{}".format(
-                urllib.parse.quote_plus(os.path.expanduser(cfg["listen"]["unix"])))
+                urllib.parse.quote_plus(expandPath(listen["unix"])))
         else:
-            serverURL = "http://127.0.0.1:{}".format(cfg["port"])
+            serverURL = "http://127.0.0.1:{}".format(
+                listen.get("port", defaultConf["listen"]["port"]))
+            if listen.get("token"):
+                # the TCP listener requires the token the server generated
+                tokenPath = expandPath(
+                    listen.get("tokenFile", os.path.join(logPath, "token")))
+                with open(tokenPath, "r") as tokenFile:
+                    headers["Authorization"] = "Bearer {}".format(
+                        tokenFile.read().strip())
 else:
     cfg = {"port": 6666, "debug": False}
     serverURL = "http://127.0.0.1:{}".format(cfg["port"])
@@ -82,6 +155,7 @@ class Gowerline(Segment):
             resp = requests.post(
                 "{}/plugin".format(serverURL),
                 json=payload,
+                headers=headers,
             )
 
             respJson = resp.json()
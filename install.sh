@@ -39,8 +39,9 @@ echo " - Installing plugins"
 wget -O ~/.gowerline/plugins.tgz "https://github.com/thomas-maurice/gowerline/releases/download/${tagName}/plugins-${tagName}_linux_amd64.tar.gz" > /dev/null 2>&1
 (cd ~/.gowerline/ ; tar zxf plugins.tgz)
 
-echo " - Installing systemd unit file"
+echo " - Installing systemd unit files"
 cp "${TEMPDIR}/${releaseDirName}/systemd/gowerline.service" ~/.config/systemd/user/gowerline.service
+cp "${TEMPDIR}/${releaseDirName}/systemd/gowerline.socket" ~/.config/systemd/user/gowerline.socket
 
 echo " - Installing upgrade script"
 cp "${TEMPDIR}/${releaseDirName}/install.sh" ~/.gowerline/bin/upgrade-gowerline
@@ -55,8 +56,8 @@ rm ~/.gowerline/plugins.tgz
 
 echo " - Refreshing systemd and restart gowerline"
 systemctl --user daemon-reload
-systemctl enable --user gowerline
-systemctl start --user gowerline
+systemctl enable --user gowerline.socket gowerline
+systemctl start --user gowerline.socket gowerline
 
 sleep 5
 
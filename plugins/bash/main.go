@@ -4,17 +4,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
 	"go.uber.org/zap"
 )
 
-var (
+// instance holds the state of one instance of the plugin
+type instance struct {
 	cfg            Config
 	stopChannel    chan bool
 	stoppedChannel chan bool
@@ -22,7 +25,9 @@ var (
 	cachedData     map[string]string
 	cacheMutex     *sync.Mutex
 	runners        []*commandRunner
-)
+	// commandDuration tracks how long the commands take to run
+	commandDuration *prometheus.HistogramVec
+}
 
 // define here the config of your plugin, if needed
 // please use a file like `~/.gowerline/<pluginName>.yaml`
@@ -34,12 +39,45 @@ type Config struct {
 	} `yaml:"commands"`
 }
 
+var minInterval = 1.0
+
+// configSchema is checked by the server before the plugin is started
+var configSchema = &types.Schema{
+	Type:     types.SchemaTypeObject,
+	Required: []string{"commands"},
+	Properties: map[string]*types.Schema{
+		"commands": {
+			Type:        types.SchemaTypeObject,
+			Description: "Commands to run, by name",
+			AdditionalProperties: &types.Schema{
+				Type:     types.SchemaTypeObject,
+				Required: []string{"cmd", "interval"},
+				Properties: map[string]*types.Schema{
+					"cmd": {
+						Type:        types.SchemaTypeString,
+						Description: "Command passed to `bash -c`",
+					},
+					"interval": {
+						Type:        types.SchemaTypeInteger,
+						Description: "Number of seconds between two runs",
+						Minimum:     &minInterval,
+					},
+					"highlightGroup": {Type: types.SchemaTypeString},
+				},
+				AdditionalProperties: types.SchemaFalse(),
+			},
+		},
+	},
+	AdditionalProperties: types.SchemaFalse(),
+}
+
 type commandRunner struct {
 	StopChannel    chan bool
 	StoppedChannel chan bool
 	Interval       int64
 	Cmd            string
 	Name           string
+	instance       *instance
 }
 
 func (c *commandRunner) run(log *zap.Logger) {
@@ -65,7 +103,9 @@ func (c *commandRunner) run(log *zap.Logger) {
 func (c *commandRunner) runCommand(log *zap.Logger) error {
 	log.Debug("running command", zap.String("command", c.Cmd))
 	cmd := exec.Command("/bin/bash", "-c", c.Cmd)
+	start := time.Now()
 	stdout, err := cmd.Output()
+	c.instance.commandDuration.WithLabelValues(c.Name).Observe(time.Since(start).Seconds())
 
 	if err != nil {
 		return err
@@ -76,9 +116,9 @@ func (c *commandRunner) runCommand(log *zap.Logger) error {
 }
 
 func (c *commandRunner) cacheResult(result string) {
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
-	cachedData[c.Name] = result
+	c.instance.cacheMutex.Lock()
+	defer c.instance.cacheMutex.Unlock()
+	c.instance.cachedData[c.Name] = result
 }
 
 // This is where you would get the plugin arguments passed
@@ -90,73 +130,93 @@ type pluginArgs struct {
 
 // This is a loop you can populate if your plugin needs to do periodic data updates
 // such as performing network calls or something.
-func run(log *zap.Logger) {
+func (i *instance) run(log *zap.Logger) {
 	log.Info("starting main loop")
 
-	for name, command := range cfg.Commands {
+	for name, command := range i.cfg.Commands {
 		runner := &commandRunner{
 			Interval:       command.Interval,
 			Name:           name,
 			Cmd:            command.Cmd,
 			StopChannel:    make(chan bool, 1),
 			StoppedChannel: make(chan bool, 1),
+			instance:       i,
 		}
 
-		runners = append(runners, runner)
+		i.runners = append(i.runners, runner)
 	}
 
 	log.Info("starting runners")
 
 	wg := &sync.WaitGroup{}
-	for _, r := range runners {
+	for _, r := range i.runners {
 		wg.Add(1)
 		runner := r
-		go func() {
+		plugins.SafeGo(log, func() {
+			defer wg.Done()
 			runner.run(log.With(zap.String("command_name", runner.Name)))
-			wg.Done()
-		}()
+		})
 	}
 
-	<-stopChannel
+	<-i.stopChannel
 
 	log.Info("terminating runners")
 
-	for _, runner := range runners {
+	for _, runner := range i.runners {
 		log.Info("sending stop signal to runner", zap.String("runner", runner.Name))
 		runner.StopChannel <- true
 	}
 
 	wg.Wait()
-	stoppedChannel <- true
+	i.stoppedChannel <- true
 }
 
 // Starts the plugin, here you might want to do all the initialisation you need
 // load up config/tokens and what not, as well to start long running goroutines
 // if your plugin requires it
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	stopChannel = make(chan bool, 1)
-	stoppedChannel = make(chan bool, 1)
-	cachedData = make(map[string]string)
-	cacheMutex = &sync.Mutex{}
-	runners = make([]*commandRunner, 0)
-
-	err := pluginConfig.Config.Decode(&cfg)
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	i.stopChannel = make(chan bool, 1)
+	i.stoppedChannel = make(chan bool, 1)
+	i.cachedData = make(map[string]string)
+	i.cacheMutex = &sync.Mutex{}
+	i.runners = make([]*commandRunner, 0)
+
+	err := i.pluginConfig.Config.Decode(&i.cfg)
 	if err != nil {
-		log.Panic("could not load configuration", zap.Error(err))
+		return nil, fmt.Errorf("could not load configuration: %w", err)
+	}
+
+	i.commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gowerline",
+		Subsystem: "bash",
+		Name:      "command_duration_seconds",
+		Help:      "Time taken by the commands to run.",
+	}, []string{"command"})
+	if i.pluginConfig.Metrics != nil {
+		err = i.pluginConfig.Metrics.Register(i.commandDuration)
+		if err != nil {
+			log.Error("could not register metrics", zap.Error(err))
+		}
 	}
-	go run(log)
+	plugins.SafeGo(log, func() { i.run(log) })
 
 	return &types.PluginStartData{
 		Metadata: types.PluginMetadata{
-			Description: "Executes bash commands on a schedule and returns the result",
-			Author:      "Thomas Maurice <thomas@maurice.fr>",
-			Version:     "0.0.1",
+			Description:  "Executes bash commands on a schedule and returns the result",
+			Author:       "Thomas Maurice <thomas@maurice.fr>",
+			Version:      "0.0.1",
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "bash",
 					Description: "Runs bash functions at regular intervals and displays the output",
-					Parameters: map[string]string{
-						"cmd": "Name of the command to run",
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "cmd",
+							Type:        types.SchemaTypeString,
+							Description: "Name of the command to run",
+							Required:    true,
+						},
 					},
 				},
 			},
@@ -165,20 +225,20 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 }
 
 // Stops anything you have started that is long runinng, like goroutines and what not
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopping plugin",
 	)
 
-	stopChannel <- true
-	<-stoppedChannel
+	i.stopChannel <- true
+	<-i.stoppedChannel
 
 	return nil
 }
 
 // Returns the actual segment iself. If your plugin handles different functions you should
 // check which one is called using the `payload.Function` attribute
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	err := json.Unmarshal(*payload.Args, &args)
 	if err != nil {
@@ -186,16 +246,16 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 		return nil, err
 	}
 
-	cacheMutex.Lock()
-	defer cacheMutex.Unlock()
+	i.cacheMutex.Lock()
+	defer i.cacheMutex.Unlock()
 
-	data, ok := cachedData[args.CmdResult]
+	data, ok := i.cachedData[args.CmdResult]
 	if !ok {
 		return nil, nil
 	}
 
 	hlgs := make([]string, 0)
-	cmdCfg, ok := cfg.Commands[args.CmdResult]
+	cmdCfg, ok := i.cfg.Commands[args.CmdResult]
 	if ok {
 		hlgs = append(hlgs, cmdCfg.HighlightGroup)
 	}
@@ -210,21 +270,29 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	}, nil
 }
 
-// Init builds and returns the plugin itself
+// Init builds and returns the plugin itself, once per instance
 func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) { //nolint:deadcode
 	log.Info(
 		"loaded plugin",
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
+		Start: i.Start,
+		Stop:  i.Stop,
+		Call:  i.Call,
 		Name:  pCfg.PluginName,
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, nil
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}
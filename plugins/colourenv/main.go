@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"regexp"
 
 	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
@@ -12,10 +13,14 @@ import (
 )
 
 var (
+	defaultHLG = "information:regular"
+)
+
+// instance holds the state of one instance of the plugin
+type instance struct {
 	cfg          Config
 	pluginConfig *plugins.PluginConfig
-	defaultHLG   = "information:regular"
-)
+}
 
 type ColourConfig struct {
 	Regex          string         `yaml:"regex"`
@@ -62,18 +67,46 @@ type pluginArgs struct {
 	Variable string `json:"variable"`
 }
 
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	err := pluginConfig.Config.Decode(&cfg)
+// configSchema is checked by the server before the plugin is started
+var configSchema = &types.Schema{
+	Type:     types.SchemaTypeObject,
+	Required: []string{"variables"},
+	Properties: map[string]*types.Schema{
+		"variables": {
+			Type:        types.SchemaTypeObject,
+			Description: "Colours of the environment variables, by variable name",
+			AdditionalProperties: &types.Schema{
+				Type: types.SchemaTypeArray,
+				Items: &types.Schema{
+					Type:     types.SchemaTypeObject,
+					Required: []string{"regex", "highlightGroup"},
+					Properties: map[string]*types.Schema{
+						"regex": {
+							Type:   types.SchemaTypeString,
+							Format: types.SchemaFormatRegex,
+						},
+						"highlightGroup": {Type: types.SchemaTypeString},
+					},
+					AdditionalProperties: types.SchemaFalse(),
+				},
+			},
+		},
+	},
+	AdditionalProperties: types.SchemaFalse(),
+}
+
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	err := i.pluginConfig.Config.Decode(&i.cfg)
 	if err != nil {
-		log.Panic("could not load configuration", zap.Error(err))
+		return nil, fmt.Errorf("could not load configuration: %w", err)
 	}
 
-	err = cfg.Compile(log)
+	err = i.cfg.Compile(log)
 	if err != nil {
-		log.Panic("failed to compile regexes", zap.Error(err))
+		return nil, fmt.Errorf("failed to compile regexes: %w", err)
 	}
 
-	for k, v := range cfg.Variables {
+	for k, v := range i.cfg.Variables {
 		for _, cf := range v {
 			log.Info("added variable", zap.String("variable", k), zap.String("regex", cf.Regex), zap.String("highlight_group", cf.HighlightGroup))
 		}
@@ -81,15 +114,21 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 
 	return &types.PluginStartData{
 		Metadata: types.PluginMetadata{
-			Description: "Displays the content of env vars with colours depending on matched regexes",
-			Author:      "Thomas Maurice <thomas@maurice.fr>",
-			Version:     "0.0.1",
+			Description:  "Displays the content of env vars with colours depending on matched regexes",
+			Author:       "Thomas Maurice <thomas@maurice.fr>",
+			Version:      "0.0.1",
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "colourenv",
 					Description: "Returns the value of environment variables coloured depending on the value",
-					Parameters: map[string]string{
-						"variable": "Environement variable to check",
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "variable",
+							Type:        types.SchemaTypeString,
+							Description: "Environement variable to check",
+							Required:    true,
+						},
 					},
 				},
 			},
@@ -98,7 +137,7 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 }
 
 // Stops anything you have started that is long runinng, like goroutines and what not
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopped plugin",
 	)
@@ -108,7 +147,7 @@ func Stop(ctx context.Context, log *zap.Logger) error {
 
 // Returns the actual segment iself. If your plugin handles different functions you should
 // check what is called using the payload.Function attribute
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	err := json.Unmarshal(*payload.Args, &args)
 	if err != nil {
@@ -121,7 +160,7 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 		return nil, nil
 	}
 
-	hlgs := cfg.GetHighlights(log, args.Variable, val)
+	hlgs := i.cfg.GetHighlights(log, args.Variable, val)
 	hlgs = append(hlgs, defaultHLG)
 
 	return []*types.PowerlineReturn{
@@ -132,21 +171,29 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	}, nil
 }
 
-// Init builds and returns the plugin itself
+// Init builds and returns the plugin itself, once per instance
 func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) { //nolint:deadcode
 	log.Info(
 		"loaded plugin",
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
+		Start: i.Start,
+		Stop:  i.Stop,
+		Call:  i.Call,
 		Name:  pCfg.PluginName,
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, nil
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}
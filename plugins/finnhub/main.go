@@ -5,25 +5,31 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Finnhub-Stock-API/finnhub-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
 	"github.com/thomas-maurice/gowerline/gowerline-server/utils/cache"
 	"go.uber.org/zap"
 )
 
-var (
-	cfg            Config
-	pluginName     = "finnhub"
-	cachedData     map[string]finnhub.Quote
-	stopChannel    chan bool
-	stoppedChannel chan bool
-	pluginConfig   *plugins.PluginConfig
+// instance holds the state of one instance of the plugin
+type instance struct {
+	cfg             Config
+	cachedData      map[string]finnhub.Quote
+	cachedDataMutex *sync.Mutex
+	stopChannel     chan bool
+	stoppedChannel  chan bool
+	pluginConfig    *plugins.PluginConfig
+	health          plugins.HealthTracker
+	apiFailures     prometheus.Counter
 
 	boltCache *cache.SimpleCache
-)
+}
 
 const (
 	DirectionUp     = "⬆️ "
@@ -47,33 +53,62 @@ type pluginArgs struct {
 	IncludeDirection bool   `json:"includeDirection"`
 }
 
+// configSchema is checked by the server before the plugin is started
+var configSchema = &types.Schema{
+	Type:     types.SchemaTypeObject,
+	Required: []string{"token", "tickers"},
+	Properties: map[string]*types.Schema{
+		"token": {
+			Type:        types.SchemaTypeString,
+			Description: "Finnhub API token",
+		},
+		"tickers": {
+			Type:        types.SchemaTypeArray,
+			Description: "Symbols of the tickers to fetch",
+			Items:       &types.Schema{Type: types.SchemaTypeString},
+		},
+		"refresh": {
+			Type:        types.SchemaTypeString,
+			Format:      types.SchemaFormatDuration,
+			Description: "How often the quotes are refreshed, at least 60s",
+		},
+	},
+	AdditionalProperties: types.SchemaFalse(),
+}
+
 // updatesTickers gets the data for caching
-func updateTickers(log *zap.Logger) error {
+func (i *instance) updateTickers(log *zap.Logger) error {
 	log.Info("updating ticker data")
 	client := finnhub.NewAPIClient(finnhub.NewConfiguration()).DefaultApi
 	ctx := context.WithValue(context.Background(), finnhub.ContextAPIKey, finnhub.APIKey{
-		Key: cfg.Token,
+		Key: i.cfg.Token,
 	})
 
-	for _, ticker := range cfg.Tickers {
+	// the refresh is healthy only when every ticker could be fetched
+	var failed []string
+	var lastErr error
+	for _, ticker := range i.cfg.Tickers {
 		quote, _, err := client.Quote(ctx, ticker)
 		if err != nil {
 			log.Error("failed to fetch quote for ticker", zap.Error(err), zap.String("ticker", ticker))
+			failed = append(failed, ticker)
+			lastErr = err
+			i.apiFailures.Inc()
 			var cached cachedTickerData
-			found, err := boltCache.Get(ticker, &cached)
+			found, err := i.boltCache.Get(ticker, &cached)
 			if err != nil {
 				log.Error("failed to fetch cached quote for ticker", zap.Error(err), zap.String("ticker", ticker))
 				continue
 			}
 			log.Info("fetched data from cache", zap.String("ticker", ticker))
 			if found {
-				cachedData[ticker] = *cached.Quote
+				i.setQuote(ticker, *cached.Quote)
 			}
 			continue
 		}
 
-		cachedData[ticker] = quote
-		err = boltCache.Put(ticker, &cachedTickerData{
+		i.setQuote(ticker, quote)
+		err = i.boltCache.Put(ticker, &cachedTickerData{
 			Timestamp: time.Now(),
 			Quote:     &quote,
 		})
@@ -82,26 +117,45 @@ func updateTickers(log *zap.Logger) error {
 		}
 	}
 
+	if len(failed) != 0 {
+		i.health.Failure(fmt.Errorf("could not fetch quote for %s: %w", strings.Join(failed, ", "), lastErr))
+	} else {
+		i.health.Success()
+	}
+
 	return nil
 }
 
-func run(log *zap.Logger) {
-	err := updateTickers(log)
+func (i *instance) setQuote(ticker string, quote finnhub.Quote) {
+	i.cachedDataMutex.Lock()
+	defer i.cachedDataMutex.Unlock()
+	i.cachedData[ticker] = quote
+}
+
+func (i *instance) getQuote(ticker string) (finnhub.Quote, bool) {
+	i.cachedDataMutex.Lock()
+	defer i.cachedDataMutex.Unlock()
+	quote, ok := i.cachedData[ticker]
+	return quote, ok
+}
+
+func (i *instance) run(log *zap.Logger) {
+	err := i.updateTickers(log)
 	if err != nil {
 		log.Error("failed to update tickers", zap.Error(err))
 	}
 
-	tck := time.NewTicker(cfg.Refresh)
+	tck := time.NewTicker(i.cfg.Refresh)
 
 	for {
 		select {
 		case <-tck.C:
-			err := updateTickers(log)
+			err := i.updateTickers(log)
 			if err != nil {
 				log.Error("failed to update tickers", zap.Error(err))
 			}
-		case <-stopChannel:
-			stoppedChannel <- true
+		case <-i.stopChannel:
+			i.stoppedChannel <- true
 			return
 		}
 	}
@@ -110,39 +164,65 @@ func run(log *zap.Logger) {
 // Starts the plugin, here you might want to do all the initialisation you need
 // load up config/tokens and what not, as well to start long running goroutines
 // if your plugin requires it
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	cachedData = make(map[string]finnhub.Quote)
-	stopChannel = make(chan bool)
-	stoppedChannel = make(chan bool)
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	i.cachedData = make(map[string]finnhub.Quote)
+	i.cachedDataMutex = &sync.Mutex{}
+	i.stopChannel = make(chan bool)
+	i.stoppedChannel = make(chan bool)
 
-	err := pluginConfig.Config.Decode(&cfg)
+	err := i.pluginConfig.Config.Decode(&i.cfg)
 	if err != nil {
-		log.Panic("could not load configuration", zap.Error(err))
+		return nil, fmt.Errorf("could not load configuration: %w", err)
 	}
 
-	for _, ticker := range cfg.Tickers {
+	for _, ticker := range i.cfg.Tickers {
 		log.Info("added ticker", zap.String("ticker", ticker))
 	}
 
-	if cfg.Refresh < time.Second*60 {
-		cfg.Refresh = time.Second * 60
+	i.apiFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gowerline",
+		Subsystem: "finnhub",
+		Name:      "api_failures_total",
+		Help:      "Number of failed calls to the Finnhub API.",
+	})
+	if i.pluginConfig.Metrics != nil {
+		err = i.pluginConfig.Metrics.Register(i.apiFailures)
+		if err != nil {
+			log.Error("could not register metrics", zap.Error(err))
+		}
 	}
 
-	log.Info(fmt.Sprintf("refreshing data every %v", cfg.Refresh))
+	if i.cfg.Refresh < time.Second*60 {
+		i.cfg.Refresh = time.Second * 60
+	}
 
-	go run(log)
+	log.Info(fmt.Sprintf("refreshing data every %v", i.cfg.Refresh))
+
+	plugins.SafeGo(log, func() { i.run(log) })
 
 	return &types.PluginStartData{
 		Metadata: types.PluginMetadata{
-			Description: "Returns information about the stock price of certain tickers",
-			Author:      "Thomas Maurice <thomas@maurice.fr>",
-			Version:     "0.0.1",
+			Description:  "Returns information about the stock price of certain tickers",
+			Author:       "Thomas Maurice <thomas@maurice.fr>",
+			Version:      "0.0.1",
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "ticker",
 					Description: "Returns the stock price of a given ticket",
-					Parameters: map[string]string{
-						"ticker": "Symbol of the ticker to return",
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "ticker",
+							Type:        types.SchemaTypeString,
+							Description: "Symbol of the ticker to return",
+							Required:    true,
+						},
+						{
+							Name:        "includeDirection",
+							Type:        types.SchemaTypeBoolean,
+							Description: "Prefix the price with an arrow showing the trend",
+							Default:     false,
+						},
 					},
 				},
 			},
@@ -151,20 +231,20 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 }
 
 // Stops anything you have started that is long runinng, like goroutines and what not
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopped plugin",
 	)
 
-	stopChannel <- true
-	<-stoppedChannel
+	i.stopChannel <- true
+	<-i.stoppedChannel
 
 	return nil
 }
 
 // Returns the actual segment iself. If your plugin handles different functions you should
 // check what is called using the payload.Function attribute
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	err := json.Unmarshal(*payload.Args, &args)
 	if err != nil {
@@ -172,7 +252,7 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 		return nil, err
 	}
 
-	quote, ok := cachedData[args.Ticker]
+	quote, ok := i.getQuote(args.Ticker)
 	if !ok {
 		return nil, nil
 	}
@@ -203,27 +283,36 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	}, nil
 }
 
-// Init builds and returns the plugin itself
+// Init builds and returns the plugin itself, once per instance
 func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) { //nolint:deadcode
 	log.Info(
 		"loaded plugin",
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	var err error
 
-	boltCache, err = cache.NewSimpleCache(cacheBucketName, pCfg.BoltDB)
+	i.boltCache, err = cache.NewSimpleCache(cacheBucketName, pCfg.BoltDB)
 
 	//err := initCacheDB(pCfg.BoltDB)
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
-		Name:  pluginName,
+		Start:  i.Start,
+		Stop:   i.Stop,
+		Call:   i.Call,
+		Health: i.health.Health,
+		Name:   pCfg.PluginName,
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, err
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -22,7 +23,8 @@ const (
 	defaultPublicIpService = "https://checkip.amazonaws.com/"
 )
 
-var (
+// instance holds the state of one instance of the plugin
+type instance struct {
 	cfg                      Config
 	stopChannel              chan bool
 	stoppedChannel           chan bool
@@ -30,7 +32,7 @@ var (
 	publicIpAddress          string
 	interfacesAddresses      map[string]string
 	interfacesAddressesMutex *sync.Mutex
-)
+}
 
 type Config struct {
 	IpService string `json:"ipService" yaml:"ipService"`
@@ -40,6 +42,19 @@ type pluginArgs struct {
 	Interface string `json:"interface"` // name of the interface to which get the address
 }
 
+// configSchema is checked by the server before the plugin is started
+var configSchema = &types.Schema{
+	Type: types.SchemaTypeObject,
+	Properties: map[string]*types.Schema{
+		"ipService": {
+			Type:        types.SchemaTypeString,
+			Description: "URL of a service returning the public IP address as plain text",
+			Pattern:     "^https?://",
+		},
+	},
+	AdditionalProperties: types.SchemaFalse(),
+}
+
 func getDefaultIPAddress(log *zap.Logger) (string, error) {
 	ip, err := gateway.DiscoverInterface()
 	if err != nil {
@@ -49,7 +64,7 @@ func getDefaultIPAddress(log *zap.Logger) (string, error) {
 	return ip.String(), nil
 }
 
-func updateIPAddresses(log *zap.Logger) error {
+func (i *instance) updateIPAddresses(log *zap.Logger) error {
 	ifaces, err := net.Interfaces()
 
 	newInterfacesAddress := make(map[string]string)
@@ -78,27 +93,27 @@ func updateIPAddresses(log *zap.Logger) error {
 	}
 	newInterfacesAddress["default"] = defaultAddress
 
-	interfacesAddressesMutex.Lock()
-	defer interfacesAddressesMutex.Unlock()
+	i.interfacesAddressesMutex.Lock()
+	defer i.interfacesAddressesMutex.Unlock()
 
-	interfacesAddresses = newInterfacesAddress
+	i.interfacesAddresses = newInterfacesAddress
 
 	return nil
 }
 
-func update(log *zap.Logger) error {
+func (i *instance) update(log *zap.Logger) error {
 	log.Info("running the update loop")
 
-	err := updateIPAddresses(log)
+	err := i.updateIPAddresses(log)
 	if err != nil {
 		log.Error("could not update the status of ip addresses", zap.Error(err))
 	}
 
-	if cfg.IpService == "" {
-		cfg.IpService = defaultPublicIpService
+	if i.cfg.IpService == "" {
+		i.cfg.IpService = defaultPublicIpService
 	}
 
-	resp, err := http.Get(cfg.IpService)
+	resp, err := http.Get(i.cfg.IpService)
 	if err != nil {
 		return err
 	}
@@ -109,13 +124,13 @@ func update(log *zap.Logger) error {
 	}
 	defer resp.Body.Close()
 
-	publicIpAddress = strings.ReplaceAll(string(b), "\n", "")
+	i.publicIpAddress = strings.ReplaceAll(string(b), "\n", "")
 
 	return nil
 }
 
-func run(log *zap.Logger) {
-	err := update(log)
+func (i *instance) run(log *zap.Logger) {
+	err := i.update(log)
 	if err != nil {
 		log.Error("failed to run plugin data refresh", zap.Error(err))
 	}
@@ -125,70 +140,74 @@ func run(log *zap.Logger) {
 	for {
 		select {
 		case <-tck.C:
-			err = update(log)
+			err = i.update(log)
 			if err != nil {
 				log.Error("could not update data", zap.Error(err))
 			}
-		case <-stopChannel:
-			stoppedChannel <- true
+		case <-i.stopChannel:
+			i.stoppedChannel <- true
 			return
 		}
 	}
 }
 
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	stopChannel = make(chan bool)
-	stoppedChannel = make(chan bool)
-	interfacesAddresses = make(map[string]string)
-	interfacesAddressesMutex = &sync.Mutex{}
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	i.stopChannel = make(chan bool)
+	i.stoppedChannel = make(chan bool)
+	i.interfacesAddresses = make(map[string]string)
+	i.interfacesAddressesMutex = &sync.Mutex{}
 
-	err := pluginConfig.Config.Decode(&cfg)
+	err := i.pluginConfig.Config.Decode(&i.cfg)
 	if err != nil {
-		log.Panic("could not load configuration", zap.Error(err))
+		return nil, fmt.Errorf("could not load configuration: %w", err)
 	}
 
-	go run(log)
+	plugins.SafeGo(log, func() { i.run(log) })
 
 	return &types.PluginStartData{
 		Metadata: types.PluginMetadata{
-			Description: "Gather information about your network connectivity",
-			Author:      "Thomas Maurice <thomas@maurice.fr>",
-			Version:     "devel",
+			Description:  "Gather information about your network connectivity",
+			Author:       "Thomas Maurice <thomas@maurice.fr>",
+			Version:      "devel",
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "public_ip",
 					Description: "Returns your public IP address",
-					Parameters:  map[string]string{},
 				},
 				{
 					Name:        "interface_ip",
 					Description: "Returns the IP of an interface",
-					Parameters: map[string]string{
-						"interface": "The interface in question",
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "interface",
+							Type:        types.SchemaTypeString,
+							Description: "The interface in question, `default` for the one of the default route",
+							Required:    true,
+						},
 					},
 				},
 				{
 					Name:        "hostname",
 					Description: "Returns the hostname of the host",
-					Parameters:  map[string]string{},
 				},
 			},
 		},
 	}, nil
 }
 
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopped plugin",
 	)
 
-	stopChannel <- true
-	<-stoppedChannel
+	i.stopChannel <- true
+	<-i.stoppedChannel
 
 	return nil
 }
 
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	err := json.Unmarshal(*payload.Args, &args)
 	if err != nil {
@@ -200,18 +219,18 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	case "public_ip":
 		return []*types.PowerlineReturn{
 			{
-				Content: publicIpAddress,
+				Content: i.publicIpAddress,
 				HighlightGroup: []string{
 					"gwl:public_ip",
 				},
 			},
 		}, nil
 	case "interface_ip":
-		interfacesAddressesMutex.Lock()
-		defer interfacesAddressesMutex.Unlock()
+		i.interfacesAddressesMutex.Lock()
+		defer i.interfacesAddressesMutex.Unlock()
 		return []*types.PowerlineReturn{
 			{
-				Content: interfacesAddresses[args.Interface],
+				Content: i.interfacesAddresses[args.Interface],
 				HighlightGroup: []string{
 					"gwl:interface_ip",
 				},
@@ -247,15 +266,23 @@ func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*pl
 		"loaded plugin",
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
+		Start: i.Start,
+		Stop:  i.Stop,
+		Call:  i.Call,
 		Name:  pCfg.PluginName,
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, nil
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
@@ -11,12 +12,15 @@ import (
 	"go.uber.org/zap"
 )
 
-var (
+// instance holds the state of one instance of the plugin. The same plugin can be
+// loaded several times with different configurations, so do not keep any state
+// in package level variables, `Init` is called once per instance.
+type instance struct {
 	cfg            Config
 	stopChannel    chan bool
 	stoppedChannel chan bool
 	pluginConfig   *plugins.PluginConfig
-)
+}
 
 // define here the config of your plugin, if needed
 // please use a file like `~/.gowerline/<pluginName>.yaml`
@@ -31,8 +35,23 @@ type pluginArgs struct {
 	SomeVariable string `json:"someVariable"`
 }
 
+// configSchema describes the configuration of the plugin, the server checks
+// the configuration against it before calling `Start` and refuses to start
+// the plugin with a precise error such as `sample.someVariable must be a string`
+var configSchema = &types.Schema{
+	Type: types.SchemaTypeObject,
+	Properties: map[string]*types.Schema{
+		"someVariable": {
+			Type:        types.SchemaTypeString,
+			Description: "some help about it",
+		},
+	},
+	// reject the keys that are not listed above, most likely typos
+	AdditionalProperties: types.SchemaFalse(),
+}
+
 // update gets the data for caching
-func update(log *zap.Logger) error {
+func (i *instance) update(log *zap.Logger) error {
 	log.Info("running the update loop")
 
 	return nil
@@ -40,8 +59,8 @@ func update(log *zap.Logger) error {
 
 // This is a loop you can populate if your plugin needs to do periodic data updates
 // such as performing network calls or something.
-func run(log *zap.Logger) {
-	err := update(log)
+func (i *instance) run(log *zap.Logger) {
+	err := i.update(log)
 	if err != nil {
 		log.Error("failed to run plugin data refresh", zap.Error(err))
 	}
@@ -52,12 +71,12 @@ func run(log *zap.Logger) {
 		select {
 		case <-tck.C:
 			// Do something here
-			err = update(log)
+			err = i.update(log)
 			if err != nil {
 				log.Error("could not update data", zap.Error(err))
 			}
-		case <-stopChannel:
-			stoppedChannel <- true
+		case <-i.stopChannel:
+			i.stoppedChannel <- true
 			return
 		}
 	}
@@ -66,16 +85,17 @@ func run(log *zap.Logger) {
 // Starts the plugin, here you might want to do all the initialisation you need
 // load up config/tokens and what not, as well to start long running goroutines
 // if your plugin requires it
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	stopChannel = make(chan bool)
-	stoppedChannel = make(chan bool)
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	i.stopChannel = make(chan bool)
+	i.stoppedChannel = make(chan bool)
 
-	err := pluginConfig.Config.Decode(&cfg)
+	err := i.pluginConfig.Config.Decode(&i.cfg)
 	if err != nil {
-		log.Panic("could not load configuration", zap.Error(err))
+		return nil, fmt.Errorf("could not load configuration: %w", err)
 	}
 
-	go run(log)
+	// SafeGo makes sure a panic in the goroutine does not crash the whole server
+	plugins.SafeGo(log, func() { i.run(log) })
 
 	// We return the metadata here instead of the `Init` function. This is because
 	// some plugins might expose some compute intensive things sometimes and might
@@ -86,12 +106,32 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 			Description: "Example plugin to show people how it works",
 			Author:      "Thomas Maurice <thomas@maurice.fr>",
 			Version:     "devel",
+			// optional, see the Init function below
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "some_function",
 					Description: "some description",
-					Parameters: map[string]string{
-						"a_param": "some help about it",
+					// the `args` of the function, calls that do not match them are
+					// rejected by the server without reaching the plugin, and the
+					// command line converts the arguments to the right type
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "someVariable",
+							Type:        types.SchemaTypeString,
+							Description: "some help about it",
+							Required:    false,
+							Default:     "some default",
+							Enum:        []interface{}{"some default", "some other value"},
+						},
+					},
+					// optional, lets the server cache the result of the function
+					// for some time rather than calling it on every prompt. Declare
+					// the environment variables and whether the working directory
+					// have an influence on the result, so they make up the cache key
+					Cache: &types.CacheDescriptor{
+						TTL: 5 * time.Second,
+						Env: []string{"USER"},
 					},
 				},
 			},
@@ -100,20 +140,20 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 }
 
 // Stops anything you have started that is long runinng, like goroutines and what not
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopped plugin",
 	)
 
-	stopChannel <- true
-	<-stoppedChannel
+	i.stopChannel <- true
+	<-i.stoppedChannel
 
 	return nil
 }
 
 // Returns the actual segment iself. If your plugin handles different functions you should
 // check which one is called using the `payload.Function` attribute
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	err := json.Unmarshal(*payload.Args, &args)
 	if err != nil {
@@ -138,25 +178,35 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	}, nil
 }
 
-// Init builds and returns the plugin itself
+// Init builds and returns the plugin itself, it is called once for every
+// instance of the plugin declared in the configuration
 func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) { //nolint:deadcode
 	log.Info(
 		"loaded plugin",
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
+		Start: i.Start,
+		Stop:  i.Stop,
+		Call:  i.Call,
 		Name:  pCfg.PluginName,
-		// Notice how you do not return any Metadata here ? This is because
+		// Notice how you do not return most of the Metadata here ? This is because
 		// it has to be returned after the `Start` function, for reasons explained
 		// above. Regardless of if you populate metadata here, it will be overwritten
-		// by whatever the `Start` function returns.
+		// by whatever the `Start` function returns. The only exception is the schema
+		// of the configuration, which has to be known before `Start` is called.
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, nil
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}
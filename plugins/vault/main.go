@@ -9,11 +9,13 @@ import (
 	"html/template"
 	"io/ioutil"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/thomas-maurice/gowerline/gowerline-server/plugins"
 	"github.com/thomas-maurice/gowerline/gowerline-server/types"
+	"github.com/thomas-maurice/gowerline/gowerline-server/utils/paths"
 	"gopkg.in/fsnotify.v1"
 
 	"go.uber.org/zap"
@@ -40,18 +42,55 @@ var (
 		"gwl:vault_expired",
 		"information:regular",
 	}
+)
+
+// Config lets you point an instance of the plugin at a specific Vault
+// cluster, by default it uses `VAULT_ADDR` and `~/.vault-token`
+type Config struct {
+	Address   string `yaml:"address"`
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// instance holds the state of one instance of the plugin
+type instance struct {
+	cfg            Config
 	pluginConfig   *plugins.PluginConfig
-	pluginName     = "vault"
 	stopChannel    chan bool
 	stoppedChannel chan bool
 	vaultState     *VaultState
-)
+	// vaultStateMutex guards vaultState, which the refresh goroutine replaces
+	vaultStateMutex *sync.Mutex
+	health          plugins.HealthTracker
+}
 
 type pluginArgs struct {
 	Template     string `json:"template"`
 	ExpiredTheme bool   `json:"expired_theme"` // changes the colour is the token is expired
 }
 
+// configSchema is checked by the server before the plugin is started
+var configSchema = &types.Schema{
+	Type: types.SchemaTypeObject,
+	Properties: map[string]*types.Schema{
+		"address": {
+			Type:        types.SchemaTypeString,
+			Description: "Address of the Vault cluster, defaults to VAULT_ADDR",
+		},
+		"tokenFile": {
+			Type:        types.SchemaTypeString,
+			Description: "File holding the Vault token, defaults to ~/.vault-token",
+		},
+	},
+	AdditionalProperties: types.SchemaFalse(),
+}
+
+func (i *instance) tokenFile() string {
+	if i.cfg.TokenFile != "" {
+		return paths.Expand(i.cfg.TokenFile)
+	}
+	return path.Join(i.pluginConfig.UserHome, ".vault-token")
+}
+
 func (vs *VaultState) Expired() bool {
 	return time.Now().Unix() >= (vs.ExpiryTime)
 }
@@ -83,15 +122,20 @@ func (vs *VaultState) Render() {
 }
 
 // updateVaultInfos gets the data for caching
-func updateVaultInfos(log *zap.Logger) error {
+func (i *instance) updateVaultInfos(log *zap.Logger) error {
 	log.Info("updating vault data")
-	client, err := api.NewClient(api.DefaultConfig())
+	vaultConfig := api.DefaultConfig()
+	if i.cfg.Address != "" {
+		vaultConfig.Address = i.cfg.Address
+	}
+
+	client, err := api.NewClient(vaultConfig)
 	if err != nil {
 		return err
 	}
 
-	if client.Token() == "" {
-		tknBytes, err := ioutil.ReadFile(path.Join(pluginConfig.UserHome, ".vault-token"))
+	if client.Token() == "" || i.cfg.TokenFile != "" {
+		tknBytes, err := ioutil.ReadFile(i.tokenFile())
 		if err != nil {
 			return err
 		}
@@ -140,16 +184,28 @@ func updateVaultInfos(log *zap.Logger) error {
 	}
 	vs.ExpiryTime = vs.CreationTime + vs.CreationTTL
 
-	vaultState = &vs
+	i.vaultStateMutex.Lock()
+	defer i.vaultStateMutex.Unlock()
+	i.vaultState = &vs
 	return nil
 }
 
-func run(log *zap.Logger) {
-	err := updateVaultInfos(log)
+// refresh updates the vault data, expiring it when the token cannot be looked up
+func (i *instance) refresh(log *zap.Logger) {
+	err := i.updateVaultInfos(log)
 	if err != nil {
-		vaultState.Expire()
+		i.vaultStateMutex.Lock()
+		i.vaultState.Expire()
+		i.vaultStateMutex.Unlock()
+		i.health.Failure(err)
 		log.Error("failed to update vault informations", zap.Error(err))
+		return
 	}
+	i.health.Success()
+}
+
+func (i *instance) run(log *zap.Logger) {
+	i.refresh(log)
 
 	tck := time.NewTicker(time.Minute)
 
@@ -159,9 +215,9 @@ func run(log *zap.Logger) {
 	}
 	defer watcher.Close()
 
-	err = watcher.Add(path.Join(pluginConfig.UserHome, ".vault-token"))
+	err = watcher.Add(i.tokenFile())
 	if err != nil {
-		log.Error("could not watch ~/.vault-token", zap.Error(err))
+		log.Error("could not watch the token file", zap.String("token_file", i.tokenFile()), zap.Error(err))
 	}
 
 	var lastUpdate time.Time
@@ -169,27 +225,19 @@ func run(log *zap.Logger) {
 	for {
 		select {
 		case <-tck.C:
-			err := updateVaultInfos(log)
-			if err != nil {
-				vaultState.Expire()
-				log.Error("failed to update vault informations", zap.Error(err))
-			}
+			i.refresh(log)
 		case _, ok := <-watcher.Events:
 			if !ok {
 				break
 			}
 
 			if time.Since(lastUpdate) > time.Second*5 {
-				log.Info("reload triggered by a change of the ~/.vault-token file")
-				err := updateVaultInfos(log)
-				if err != nil {
-					vaultState.Expire()
-					log.Error("failed to update vault informations", zap.Error(err))
-				}
+				log.Info("reload triggered by a change of the token file")
+				i.refresh(log)
 				lastUpdate = time.Now()
 			}
-		case <-stopChannel:
-			stoppedChannel <- true
+		case <-i.stopChannel:
+			i.stoppedChannel <- true
 			return
 		}
 	}
@@ -198,29 +246,49 @@ func run(log *zap.Logger) {
 // Starts the plugin, here you might want to do all the initialisation you need
 // load up config/tokens and what not, as well to start long running goroutines
 // if your plugin requires it
-func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
-	stopChannel = make(chan bool)
-	stoppedChannel = make(chan bool)
-	vaultState = &VaultState{}
+func (i *instance) Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error) {
+	i.stopChannel = make(chan bool)
+	i.stoppedChannel = make(chan bool)
+	i.vaultState = &VaultState{}
+	i.vaultStateMutex = &sync.Mutex{}
+
+	// If it even has a config
+	if i.pluginConfig.Config.Kind != 0 {
+		err := i.pluginConfig.Config.Decode(&i.cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	log.Info(
 		"started plugin",
-		zap.String("plugin", pluginName),
 	)
 
-	go run(log)
+	plugins.SafeGo(log, func() { i.run(log) })
 
 	return &types.PluginStartData{
 		Metadata: types.PluginMetadata{
-			Description: "Gathers information about the current Vault token and formats the result",
-			Author:      "Thomas Maurice <thomas@maurice.fr>",
-			Version:     "0.0.1",
+			Description:  "Gathers information about the current Vault token and formats the result",
+			Author:       "Thomas Maurice <thomas@maurice.fr>",
+			Version:      "0.0.1",
+			ConfigSchema: configSchema,
 			Functions: []types.FunctionDescriptor{
 				{
 					Name:        "vault",
 					Description: "Displays informations about Vault using a formatting string",
-					Parameters: map[string]string{
-						"template": "Template string to render",
+					Parameters: []types.ParameterDescriptor{
+						{
+							Name:        "template",
+							Type:        types.SchemaTypeString,
+							Description: "Template string to render",
+							Default:     defaultTemplate,
+						},
+						{
+							Name:        "expired_theme",
+							Type:        types.SchemaTypeBoolean,
+							Description: "Use the gwl:vault_expired highlight group once the token expired",
+							Default:     false,
+						},
 					},
 				},
 			},
@@ -229,17 +297,20 @@ func Start(ctx context.Context, log *zap.Logger) (*types.PluginStartData, error)
 }
 
 // Stops anything you have started that is long runinng, like goroutines and what not
-func Stop(ctx context.Context, log *zap.Logger) error {
+func (i *instance) Stop(ctx context.Context, log *zap.Logger) error {
 	log.Info(
 		"stopped plugin",
-		zap.String("plugin", pluginName),
 	)
+
+	i.stopChannel <- true
+	<-i.stoppedChannel
+
 	return nil
 }
 
 // Returns the actual segment iself. If your plugin handles different functions you should
 // check what is called using the payload.Function attribute
-func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
+func (i *instance) Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*types.PowerlineReturn, error) {
 	var args pluginArgs
 	if payload.Args != nil {
 		err := json.Unmarshal(*payload.Args, &args)
@@ -253,13 +324,17 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 		args.Template = defaultTemplate
 	}
 
+	// the state is rendered from a copy, the refresh goroutine may update it meanwhile
+	i.vaultStateMutex.Lock()
+	vaultState := *i.vaultState
+	i.vaultStateMutex.Unlock()
 	vaultState.Render()
 	t, err := template.New("segment").Parse(args.Template)
 	if err != nil {
 		return nil, err
 	}
 	wr := bytes.NewBufferString("")
-	err = t.Execute(wr, vaultState)
+	err = t.Execute(wr, &vaultState)
 	if err != nil {
 		return nil, err
 	}
@@ -277,22 +352,30 @@ func Call(ctx context.Context, log *zap.Logger, payload *types.Payload) ([]*type
 	}, nil
 }
 
-// Init builds and returns the plugin itself
+// Init builds and returns the plugin itself, once per instance
 func Init(ctx context.Context, log *zap.Logger, pCfg *plugins.PluginConfig) (*plugins.Plugin, error) { //nolint:deadcode
 	log.Info(
 		"loaded plugin",
-		zap.String("plugin", pluginName),
 	)
 
-	pluginConfig = pCfg
+	i := &instance{
+		pluginConfig: pCfg,
+	}
 
 	return &plugins.Plugin{
-		Start: Start,
-		Stop:  Stop,
-		Call:  Call,
-		Name:  pluginName,
+		Start:  i.Start,
+		Stop:   i.Stop,
+		Call:   i.Call,
+		Health: i.health.Health,
+		Name:   pCfg.PluginName,
+		Metadata: types.PluginMetadata{
+			ConfigSchema: configSchema,
+		},
 	}, nil
 }
 
-// noop main function
-func main() {}
+// main is only used when the plugin is ran out of process
+// with the `grpc` transport, it is ignored by `-buildmode=plugin`
+func main() {
+	plugins.Serve(Init)
+}